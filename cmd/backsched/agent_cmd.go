@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/mbrt/backsched/internal/agent"
+	"github.com/mbrt/backsched/internal/api"
+	"github.com/mbrt/backsched/internal/backup"
+)
+
+var agentTTL time.Duration
+
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Manage the secret agent, holding unlocked secrets for unattended runs",
+}
+
+var agentStartCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Start the secret agent in the foreground",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runAgentStart(); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	},
+}
+
+var agentUnlockCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "Ask the secrets of all the backups and store them in the agent",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runAgentUnlock(); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	},
+}
+
+var agentLockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Wipe all the secrets from the agent",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := agent.NewClient(agentSocket()).Lock(); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(agentCmd)
+	agentCmd.AddCommand(agentStartCmd, agentUnlockCmd, agentLockCmd)
+
+	agentStartCmd.Flags().DurationVarP(&agentTTL, "ttl", "", 8*time.Hour, "how long secrets are kept by default.")
+	agentUnlockCmd.Flags().DurationVarP(&agentTTL, "ttl", "", 0, "how long the secrets are kept. Defaults to the agent TTL.")
+}
+
+func runAgentStart() error {
+	a := agent.New(clockwork.NewRealClock(), agentTTL)
+	sock := agentSocket()
+	l, err := api.Listen("unix:" + sock)
+	if err != nil {
+		return err
+	}
+	hs := &http.Server{Handler: a.Handler()}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := hs.Shutdown(sctx); err != nil {
+			log.Error().Err(err).Msg("Shutting down the agent")
+		}
+	}()
+	go func() {
+		// Wipe expired secrets even when nobody asks for them.
+		t := time.NewTicker(time.Minute)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				a.Expire()
+			}
+		}
+	}()
+	defer a.Lock()
+
+	log.Info().Msgf("Agent listening on %s", sock)
+	if err := hs.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func runAgentUnlock() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(cfg)
+	if err != nil {
+		return err
+	}
+	// Always ask, even if the secrets are already unlocked.
+	env.Secrets = interactiveSecrets()
+	vals, err := backup.AskSecrets(ctx, cfg, env)
+	fmt.Println()
+	if err != nil {
+		return err
+	}
+
+	var secrets []agent.Secret
+	for _, v := range vals {
+		secrets = append(secrets, agent.Secret{Backup: v.Backup, ID: v.ID, Value: v.Value})
+	}
+	if err := agent.NewClient(agentSocket()).Add(secrets, agentTTL); err != nil {
+		return err
+	}
+	log.Info().Msgf("Unlocked %d secrets", len(secrets))
+	return nil
+}
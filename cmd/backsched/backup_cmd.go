@@ -1,19 +1,21 @@
 package main
 
 import (
-	"fmt"
-	"path"
+	"errors"
 
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 
 	"github.com/mbrt/backsched/internal/backup"
-	"github.com/mbrt/backsched/internal/config"
 )
 
 var (
 	dryRun     bool
 	askSecrets bool
+	skipVerify bool
+	resume     bool
+	// backupOutput is the format of the plan printed in dry run mode.
+	backupOutput string
 )
 
 var backupCmd = &cobra.Command{
@@ -31,16 +33,35 @@ func init() {
 
 	backupCmd.Flags().BoolVarP(&dryRun, "dry-run", "", false, "only simulate the backup run.")
 	backupCmd.Flags().BoolVarP(&askSecrets, "ask-secrets", "", true, "whether to interactively ask secrets.")
+	backupCmd.Flags().BoolVarP(&skipVerify, "skip-verify", "", false, "do not run the verifications that are due.")
+	backupCmd.Flags().BoolVarP(&resume, "resume", "", false, "continue the incomplete backups from the first command not completed.")
+	backupCmd.Flags().StringVarP(&backupOutput, "output", "o", "",
+		"with --dry-run, print the plan in the given format (text or json) instead of simulating the run.")
 }
 
 func runBackup() error {
-	p := path.Join(cfgDir.Path, configFile)
-	cfg, err := config.Parse(p)
+	if backupOutput != "" {
+		if !dryRun {
+			return errors.New("--output requires --dry-run")
+		}
+		if err := checkOutput(backupOutput); err != nil {
+			return err
+		}
+		return printPlan(backupOutput, backup.Opts{SkipVerify: skipVerify, Resume: resume})
+	}
+	// Dry runs log the commands, so they don't need the decrypted values.
+	cfg, err := loadConfigWith(dryRun)
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(cfg)
 	if err != nil {
-		return fmt.Errorf("parsing config %q: %w", p, err)
+		return err
 	}
-	return backup.Run(ctx, cfg, env(), backup.Opts{
+	return backup.Run(ctx, cfg, env, backup.Opts{
 		DryRun:     dryRun,
 		AskSecrets: askSecrets,
+		SkipVerify: skipVerify,
+		Resume:     resume,
 	})
 }
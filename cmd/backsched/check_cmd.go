@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"path"
 	"strings"
 
 	"github.com/gen2brain/beeep"
@@ -10,7 +9,6 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/mbrt/backsched/internal/backup"
-	"github.com/mbrt/backsched/internal/config"
 )
 
 var notify bool
@@ -32,26 +30,48 @@ func init() {
 }
 
 func runCheck() error {
-	p := path.Join(cfgDir.Path, configFile)
-	cfg, err := config.Parse(p)
+	cfg, err := loadConfig()
 	if err != nil {
-		return fmt.Errorf("parsing config %q: %w", p, err)
+		return err
 	}
-	infos, err := backup.ComputeOutdated(ctx, cfg, env())
+	env, err := newEnv(cfg)
+	if err != nil {
+		return err
+	}
+	infos, err := backup.ComputeOutdated(ctx, cfg, env)
 	if err != nil {
 		return fmt.Errorf("in compute outdated: %v", err)
 	}
 
+	vinfos, err := backup.ComputeVerifyIssues(ctx, cfg, env)
+	if err != nil {
+		return fmt.Errorf("in compute verify issues: %v", err)
+	}
+
 	for _, b := range infos {
 		log.Info().Str("backup", b.Backup.Name).Msgf("Needs backup: %v", b)
 	}
+	for _, v := range vinfos {
+		log.Info().Str("backup", v.Backup.Name).Msgf("Needs verification: %v", v)
+	}
 	if len(infos) > 0 {
 		summary := "The following backups are outdated:"
 		if notify {
-			return beeep.Notify(summary, report(infos), "")
+			if err := beeep.Notify(summary, report(infos), ""); err != nil {
+				return err
+			}
+		} else {
+			fmt.Println(summary)
+			fmt.Println(report(infos))
+		}
+	}
+	if len(vinfos) > 0 {
+		summary := "The following backups need verification:"
+		if notify {
+			return beeep.Notify(summary, reportVerify(vinfos), "")
 		}
 		fmt.Println(summary)
-		fmt.Println(report(infos))
+		fmt.Println(reportVerify(vinfos))
 	}
 
 	return nil
@@ -64,3 +84,11 @@ func report(infos []backup.Info) string {
 	}
 	return strings.Join(msg, "")
 }
+
+func reportVerify(infos []backup.VerifyInfo) string {
+	var msg []string
+	for _, info := range infos {
+		msg = append(msg, fmt.Sprintf("  - %s\n", info))
+	}
+	return strings.Join(msg, "")
+}
@@ -3,12 +3,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"path"
 
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
-
-	"github.com/mbrt/backsched/internal/config"
 )
 
 var configCmd = &cobra.Command{
@@ -26,10 +23,10 @@ func init() {
 }
 
 func runConfig() error {
-	p := path.Join(cfgDir.Path, configFile)
-	cfg, err := config.Parse(p)
+	// Never print decrypted values.
+	cfg, err := loadConfigWith(true)
 	if err != nil {
-		return fmt.Errorf("parsing config %q: %w", p, err)
+		return err
 	}
 	b, err := json.MarshalIndent(cfg, "", "  ")
 	if err != nil {
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/mbrt/backsched/internal/api"
+	"github.com/mbrt/backsched/internal/backup"
+)
+
+var (
+	listenAddr string
+	runEvery   time.Duration
+)
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Serve an HTTP API to inspect and run the backups",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runDaemon(); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(daemonCmd)
+
+	daemonCmd.Flags().StringVarP(&listenAddr, "listen", "", "", "address to listen to, or unix:<path> for a unix socket. Defaults to a unix socket in the config directory.")
+	daemonCmd.Flags().DurationVarP(&runEvery, "run-every", "", 0, "if non-zero, how often to run outdated backups.")
+}
+
+func runDaemon() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(cfg)
+	if err != nil {
+		return err
+	}
+	// There's no terminal to ask secrets from: they must be unlocked in the
+	// agent. Runs needing other secrets fail.
+	env.Secrets = newUnattendedSecretGetter()
+	srv := api.New(ctx, cfg, env, backup.Opts{AskSecrets: true})
+
+	if listenAddr == "" {
+		listenAddr = "unix:" + path.Join(cfgDir.Path, daemonSocketFile)
+	}
+	l, err := api.Listen(listenAddr)
+	if err != nil {
+		return err
+	}
+	hs := &http.Server{Handler: srv.Handler()}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := hs.Shutdown(sctx); err != nil {
+			log.Error().Err(err).Msg("Shutting down HTTP server")
+		}
+	}()
+	if runEvery > 0 {
+		go triggerEvery(srv, runEvery)
+	}
+
+	log.Info().Msgf("Listening on %s", listenAddr)
+	if err := hs.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// Runs are bound to the global context, so they are canceled already.
+	srv.Wait()
+	return nil
+}
+
+func triggerEvery(srv *api.Server, d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		if !srv.Trigger() {
+			log.Info().Msg("Skipping scheduled run: a run is already in progress")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
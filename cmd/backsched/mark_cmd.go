@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/mbrt/backsched/internal/backup"
+)
+
+var markAt string
+
+var markCmd = &cobra.Command{
+	Use:   "mark <name>",
+	Short: "Marks a backup as done, e.g. after running it manually",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runMark(args[0]); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(markCmd)
+
+	markCmd.Flags().StringVarP(&markAt, "at", "", "",
+		"when the backup was done, in RFC3339 format or as a duration ago (e.g. '2h'). Defaults to now.")
+}
+
+func runMark(name string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(cfg)
+	if err != nil {
+		return err
+	}
+	t, err := parseMarkTime(markAt, env.Clock.Now())
+	if err != nil {
+		return fmt.Errorf("parsing --at: %w", err)
+	}
+	return backup.Mark(ctx, cfg, env, name, t)
+}
+
+// parseMarkTime parses either an absolute time or a duration ago.
+func parseMarkTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return now, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected a RFC3339 time or a duration, got %q", s)
+	}
+	return now.Add(-d), nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/mbrt/backsched/internal/backup"
+)
+
+var metricsOutput string
+
+var metricsCmd = &cobra.Command{
+	Use:   "metrics",
+	Short: "Export backup metrics in the Prometheus text format",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runMetrics(); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(metricsCmd)
+
+	metricsCmd.Flags().StringVarP(&metricsOutput, "output", "o", "", "file where to write the metrics, instead of stdout.")
+}
+
+func runMetrics() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(cfg)
+	if err != nil {
+		return err
+	}
+	if metricsOutput == "" {
+		return backup.WriteMetrics(os.Stdout, cfg, env)
+	}
+	return backup.WriteMetricsFile(metricsOutput, cfg, env)
+}
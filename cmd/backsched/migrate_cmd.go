@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/mbrt/backsched/internal/config"
+)
+
+var migrateOutput string
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Migrate the evaluated configuration to the latest format version",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runMigrate(); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	},
+}
+
+func init() {
+	configCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().StringVarP(&migrateOutput, "output", "o", "", "file where to write the migrated config.")
+}
+
+func runMigrate() error {
+	p, err := configPath()
+	if err != nil {
+		return err
+	}
+	opts, err := evalOpts()
+	if err != nil {
+		return err
+	}
+	m, err := config.MigrateFile(p, opts)
+	if err != nil {
+		return err
+	}
+	if m.From == config.Version {
+		log.Info().Msgf("Config is already at the latest version %q", m.From)
+	} else {
+		fmt.Print(m.Diff())
+	}
+
+	if migrateOutput == "" {
+		return nil
+	}
+	if m.Encrypted {
+		// The ciphertexts can't be recovered from the evaluated config.
+		return errors.New("the config contains encrypted values, which would be lost: apply the diff to the config manually")
+	}
+	if err := os.WriteFile(migrateOutput, []byte(m.After), 0o600); err != nil {
+		return fmt.Errorf("writing migrated config: %w", err)
+	}
+	log.Info().Msgf("Migrated config written to %q", migrateOutput)
+	return nil
+}
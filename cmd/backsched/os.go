@@ -1,23 +1,45 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/jonboulle/clockwork"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/afero"
 	"golang.org/x/term"
 
+	"github.com/mbrt/backsched/internal/agent"
 	"github.com/mbrt/backsched/internal/backup"
 	"github.com/mbrt/backsched/internal/config"
 	"github.com/mbrt/backsched/internal/exec"
+	"github.com/mbrt/backsched/internal/pinentry"
+	"github.com/mbrt/backsched/internal/store"
 )
 
 const (
-	stateFile  = "state.json"
-	configFile = "config.jsonnet"
+	stateFile    = "state.json"
+	configName   = "config"
+	envAllowFile = "env.allow"
+	// identityFile contains the age identities decrypting the config values.
+	identityFile = "identity.txt"
+	// agentSocketFile is the default socket of the secret agent, in the
+	// config directory.
+	agentSocketFile = "agent.sock"
+	agentSocketEnv  = "BACKSCHED_AGENT_SOCK"
+	// daemonSocketFile is the default socket of the daemon API, in the
+	// config directory.
+	daemonSocketFile = "daemon.sock"
+	// pinentryEnv overrides the pinentry program used when there's no
+	// terminal.
+	pinentryEnv = "BACKSCHED_PINENTRY"
+	// killGrace is how long running commands have to terminate after the run
+	// is canceled, before they are killed.
+	killGrace = 30 * time.Second
 )
 
 type stateIO struct{}
@@ -39,26 +61,263 @@ func (s stateIO) Load() ([]byte, error) {
 	return b, nil
 }
 
-type secrets struct{}
+// termSecrets asks the secrets interactively on the terminal.
+type termSecrets struct{}
 
-func (secrets) Secret(backup string, s config.Secret) string {
-	fmt.Printf("[backup %q %s]: ", backup, s.ID)
+func (termSecrets) Secret(backup string, s config.Secret) (string, error) {
+	if backup == "" {
+		fmt.Printf("[%s]: ", s.ID)
+	} else {
+		fmt.Printf("[backup %q %s]: ", backup, s.ID)
+	}
 	b, err := term.ReadPassword(int(os.Stdin.Fd()))
 	if err != nil {
-		log.Fatal().
-			Err(err).
-			Str("backup", backup).
-			Msgf("Reading secret for ID=%s", s.ID)
+		return "", fmt.Errorf("reading from the terminal: %w", err)
+	}
+	return string(b), nil
+}
+
+// pinentrySecrets asks the secrets through a pinentry program, for when
+// there's no terminal.
+type pinentrySecrets struct {
+	client pinentry.Client
+}
+
+func (p pinentrySecrets) Secret(backup string, s config.Secret) (string, error) {
+	desc := fmt.Sprintf("Enter the secret %q", s.ID)
+	if backup != "" {
+		desc += fmt.Sprintf(" for backup %q", backup)
+	}
+	return p.client.GetPin(ctx, pinentry.Prompt{
+		Title:  "backsched",
+		Desc:   desc,
+		Prompt: s.ID + ":",
+	})
+}
+
+// interactiveSecrets asks the secrets on the terminal, or through pinentry
+// if stdin is not a terminal.
+func interactiveSecrets() backup.SecretGetter {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		return termSecrets{}
+	}
+	prog := os.Getenv(pinentryEnv)
+	if prog == "" {
+		prog = pinentry.DefaultProgram
+	}
+	return pinentrySecrets{pinentry.Client{Program: prog}}
+}
+
+// agentSecrets takes the secrets from the agent, falling back to asking
+// them when not unlocked.
+type agentSecrets struct {
+	client   agent.Client
+	fallback backup.SecretGetter
+}
+
+func (a agentSecrets) Secret(backup string, s config.Secret) (string, error) {
+	v, err := a.client.Secret(backup, s.ID)
+	if err == nil {
+		return v, nil
+	}
+	if !errors.Is(err, agent.ErrNotFound) {
+		log.Warn().Err(err).Msg("Querying the secret agent")
 	}
-	return string(b)
+	log.Info().Str("backup", backup).Msgf("Secret ID=%s is not unlocked in the agent", s.ID)
+	return a.fallback.Secret(backup, s)
 }
 
-func env() backup.Env {
+// Invalidate removes a secret failing validation from the agent, so that it's
+// asked again.
+func (a agentSecrets) Invalidate(backup string, s config.Secret) {
+	if err := a.client.Remove(backup, s.ID); err != nil {
+		log.Warn().Err(err).Msg("Removing invalid secret from the agent")
+	}
+}
+
+// agentSocket returns the path to the socket of the secret agent.
+func agentSocket() string {
+	if p := os.Getenv(agentSocketEnv); p != "" {
+		return p
+	}
+	return path.Join(cfgDir.Path, agentSocketFile)
+}
+
+// newSecretGetter uses the secret agent if running, or asks the secrets
+// otherwise.
+func newSecretGetter() backup.SecretGetter {
+	if _, err := os.Stat(agentSocket()); err == nil {
+		return agentSecrets{agent.NewClient(agentSocket()), interactiveSecrets()}
+	}
+	return interactiveSecrets()
+}
+
+// unattendedSecrets fails to get any secret, as there's nobody to ask.
+type unattendedSecrets struct{}
+
+func (unattendedSecrets) Secret(_ string, s config.Secret) (string, error) {
+	return "", fmt.Errorf("secret ID=%s can't be asked in unattended runs: unlock it with `backsched agent unlock`", s.ID)
+}
+
+// newUnattendedSecretGetter uses the secret agent if running, and fails for
+// the secrets not available there.
+func newUnattendedSecretGetter() backup.SecretGetter {
+	if _, err := os.Stat(agentSocket()); err == nil {
+		return agentSecrets{agent.NewClient(agentSocket()), unattendedSecrets{}}
+	}
+	return unattendedSecrets{}
+}
+
+func newEnv(cfg config.Config) (backup.Env, error) {
+	clock := clockwork.NewRealClock()
+	fs := afero.NewOsFs()
+	host, err := config.CurrentHost()
+	if err != nil {
+		return backup.Env{}, err
+	}
+	sio, err := newStateIO(cfg.State, fs, clock, host.Name)
+	if err != nil {
+		return backup.Env{}, err
+	}
 	return backup.Env{
-		Sio:     stateIO{},
-		Clock:   clockwork.NewRealClock(),
-		Fs:      afero.NewOsFs(),
-		Runner:  exec.DefaultRunner{},
-		Secrets: secrets{},
+		Sio:     sio,
+		Clock:   clock,
+		Fs:      fs,
+		Runner:  exec.DefaultRunner{Kill: forceStop, Grace: killGrace},
+		Secrets: newSecretGetter(),
+		Host:    host,
+	}, nil
+}
+
+// newStateIO returns the state store configured in the config, defaulting
+// to a state file in the config directory.
+func newStateIO(st *config.StateStore, fs afero.Fs, clock clockwork.Clock, owner string) (backup.StateIOer, error) {
+	if st == nil {
+		return stateIO{}, nil
+	}
+	if st.Path != nil {
+		return store.File{
+			Fs:    fs,
+			Clock: clock,
+			Path:  *st.Path,
+			Owner: owner,
+		}, nil
+	}
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("the S3 state store needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to be set")
+	}
+	return store.S3{
+		Endpoint:  st.S3.Endpoint,
+		Region:    st.S3.Region,
+		Bucket:    st.S3.Bucket,
+		Key:       st.S3.Key,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Owner:     owner,
+		Clock:     clock,
+	}, nil
+}
+
+// configPath returns the path to the config file in the config directory,
+// in any of the supported formats.
+func configPath() (string, error) {
+	var found []string
+	for _, ext := range config.Extensions {
+		if cfgDir.Exists(configName + ext) {
+			found = append(found, configName+ext)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no config file found in %q", cfgDir.Path)
+	case 1:
+		return path.Join(cfgDir.Path, found[0]), nil
+	default:
+		return "", fmt.Errorf("multiple config files found in %q: %s",
+			cfgDir.Path, strings.Join(found, ", "))
+	}
+}
+
+// loadConfig parses the config in the config directory.
+func loadConfig() (config.Config, error) {
+	return loadConfigWith(false)
+}
+
+// loadConfigWith parses the config in the config directory. When redact is
+// true, the encrypted values are not decrypted.
+func loadConfigWith(redact bool) (config.Config, error) {
+	p, err := configPath()
+	if err != nil {
+		return config.Config{}, err
+	}
+	opts, err := evalOpts()
+	if err != nil {
+		return config.Config{}, err
+	}
+	opts.Redact = redact
+	cfg, err := config.ParseWith(p, opts)
+	if err != nil {
+		return cfg, fmt.Errorf("parsing config %q: %w", p, err)
+	}
+	return cfg, nil
+}
+
+// evalOpts collects the config evaluation options from the command line
+// flags and the environment allowlist in the config directory.
+func evalOpts() (config.EvalOpts, error) {
+	var (
+		res config.EvalOpts
+		err error
+	)
+	if cfgDir.Exists(envAllowFile) {
+		b, err := cfgDir.ReadFile(envAllowFile)
+		if err != nil {
+			return res, fmt.Errorf("reading %q: %w", envAllowFile, err)
+		}
+		if res.Env, err = config.ParseEnvAllowlist(b); err != nil {
+			return res, fmt.Errorf("parsing %q: %w", envAllowFile, err)
+		}
+	}
+	if cfgDir.Exists(identityFile) {
+		b, err := cfgDir.ReadFile(identityFile)
+		if err != nil {
+			return res, fmt.Errorf("reading %q: %w", identityFile, err)
+		}
+		if res.Identities, err = config.ParseIdentities(b); err != nil {
+			return res, fmt.Errorf("parsing %q: %w", identityFile, err)
+		}
+	}
+	if res.ExtStrs, err = parseKeyValues(extStrFlags, true); err != nil {
+		return res, fmt.Errorf("parsing --ext-str: %w", err)
+	}
+	if res.ExtCodes, err = parseKeyValues(extCodeFlags, false); err != nil {
+		return res, fmt.Errorf("parsing --ext-code: %w", err)
+	}
+	if res.TLAStrs, err = parseKeyValues(tlaStrFlags, true); err != nil {
+		return res, fmt.Errorf("parsing --tla-str: %w", err)
+	}
+	return res, nil
+}
+
+// parseKeyValues parses a list of key=value strings. When fromEnv is true,
+// a lone key takes its value from the environment, like the jsonnet CLI does.
+func parseKeyValues(kvs []string, fromEnv bool) (map[string]string, error) {
+	res := map[string]string{}
+	for _, kv := range kvs {
+		parts := strings.SplitN(kv, "=", 2)
+		switch {
+		case len(parts) == 2:
+			res[parts[0]] = parts[1]
+		case fromEnv:
+			v, ok := os.LookupEnv(kv)
+			if !ok {
+				return nil, fmt.Errorf("environment variable %q is not set", kv)
+			}
+			res[kv] = v
+		default:
+			return nil, fmt.Errorf("expected key=value, got %q", kv)
+		}
 	}
+	return res, nil
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/mbrt/backsched/internal/backup"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+var planOutput string
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Print what a backup run would do, without running anything",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runPlan(); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+
+	planCmd.Flags().StringVarP(&planOutput, "output", "o", outputText, "output format, either text or json.")
+	planCmd.Flags().BoolVarP(&skipVerify, "skip-verify", "", false, "do not plan the verifications that are due.")
+	planCmd.Flags().BoolVarP(&resume, "resume", "", false, "plan to continue the incomplete backups from their checkpoint.")
+}
+
+func runPlan() error {
+	if err := checkOutput(planOutput); err != nil {
+		return err
+	}
+	return printPlan(planOutput, backup.Opts{SkipVerify: skipVerify, Resume: resume})
+}
+
+func checkOutput(o string) error {
+	if o != outputText && o != outputJSON {
+		return fmt.Errorf("unknown output format %q, expected %s or %s", o, outputText, outputJSON)
+	}
+	return nil
+}
+
+func printPlan(output string, opts backup.Opts) error {
+	// The plan prints the commands with their environment: never show the
+	// decrypted values.
+	cfg, err := loadConfigWith(true)
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(cfg)
+	if err != nil {
+		return err
+	}
+	plan, err := backup.ComputePlan(ctx, cfg, env, opts)
+	if err != nil {
+		return err
+	}
+	if output == outputJSON {
+		b, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	writePlan(os.Stdout, plan)
+	return nil
+}
+
+func writePlan(w io.Writer, plan backup.Plan) {
+	for _, b := range plan.Backups {
+		action := "skip"
+		if b.Run {
+			action = "run"
+		}
+		fmt.Fprintf(w, "%s: %s (%s)\n", b.Name, action, b.Reason)
+		if b.Freshness != "" {
+			fmt.Fprintf(w, "  freshness: %s\n", b.Freshness)
+		}
+		if b.ResumeFrom > 0 {
+			fmt.Fprintf(w, "  resume from command %d\n", b.ResumeFrom+1)
+		}
+		for _, r := range b.Requirements {
+			status := "ok"
+			if !r.OK {
+				status = r.Error
+			}
+			fmt.Fprintf(w, "  requires %s: %s\n", r.Path, status)
+		}
+		writeCommands(w, "  ", b.Commands)
+		if b.Verify != nil {
+			due := "not due"
+			if b.Verify.Due {
+				due = "due"
+			}
+			fmt.Fprintf(w, "  verify: %s\n", due)
+			writeCommands(w, "    ", b.Verify.Commands)
+		}
+	}
+}
+
+func writeCommands(w io.Writer, indent string, cmds []backup.PlannedCommand) {
+	for _, c := range cmds {
+		line := append([]string{c.Cmd}, c.Args...)
+		fmt.Fprintf(w, "%s$ %s\n", indent, strings.Join(line, " "))
+		if c.Workdir != "" {
+			fmt.Fprintf(w, "%s    workdir: %s\n", indent, c.Workdir)
+		}
+		for _, m := range []map[string]string{c.Env, c.SecretEnv, c.SecretFiles} {
+			for _, k := range sortedKeys(m) {
+				fmt.Fprintf(w, "%s    %s=%s\n", indent, k, m[k])
+			}
+		}
+		if c.SecretStdin != "" {
+			fmt.Fprintf(w, "%s    stdin: %s\n", indent, c.SecretStdin)
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	var res []string
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/mbrt/backsched/internal/backup"
+)
+
+var resetStale bool
+
+var resetCmd = &cobra.Command{
+	Use:   "reset [name...]",
+	Short: "Resets the given backups to never done, or removes the stale state entries",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runReset(args); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(resetCmd)
+
+	resetCmd.Flags().BoolVarP(&resetStale, "stale", "", false,
+		"remove the state of the backups no longer in the config.")
+}
+
+func runReset(names []string) error {
+	if resetStale == (len(names) > 0) {
+		return errors.New("either backup names or --stale are required")
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(cfg)
+	if err != nil {
+		return err
+	}
+	if !resetStale {
+		return backup.Reset(ctx, cfg, env, names)
+	}
+	removed, err := backup.Prune(ctx, cfg, env)
+	if err != nil {
+		return err
+	}
+	for _, r := range removed {
+		fmt.Printf("Removed %q\n", r)
+	}
+	return nil
+}
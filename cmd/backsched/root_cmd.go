@@ -4,12 +4,15 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/shibukawa/configdir"
 	"github.com/spf13/cobra"
+
+	"github.com/mbrt/backsched/internal/config"
 )
 
 var (
@@ -18,8 +21,16 @@ var (
 	cfgDirs    configdir.ConfigDir
 	cfgDir     *configdir.Config
 
+	// Config evaluation.
+	extStrFlags  []string
+	extCodeFlags []string
+	tlaStrFlags  []string
+
 	// Global context.
 	ctx context.Context
+	// forceStop is closed on the second termination signal, to kill the
+	// commands still running.
+	forceStop = make(chan struct{})
 )
 
 var rootCmd = &cobra.Command{
@@ -34,13 +45,25 @@ func init() {
 		initConfig()
 	})
 	rootCmd.PersistentFlags().StringVar(&cfgDirFlag, "config", "", "config directory")
+	rootCmd.PersistentFlags().StringArrayVar(&extStrFlags, "ext-str", nil, "external string variable for the config, as key=value, or key to take it from the environment")
+	rootCmd.PersistentFlags().StringArrayVar(&extCodeFlags, "ext-code", nil, "external code variable for the config, as key=code")
+	rootCmd.PersistentFlags().StringArrayVar(&tlaStrFlags, "tla-str", nil, "top-level string argument for the config, as key=value")
 }
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	cfgDirs = configdir.New("mbrt", "backsched")
 	cfgDirs.LocalPath = cfgDirFlag
-	cfgDir = cfgDirs.QueryFolderContainsFile("config.jsonnet")
+	for _, dir := range cfgDirs.QueryFolders(configdir.Existing) {
+		for _, ext := range config.Extensions {
+			if dir.Exists(configName + ext) {
+				cfgDir = dir
+				return
+			}
+		}
+	}
+	// No config found: default to the folder with the highest priority.
+	cfgDir = cfgDirs.QueryFolders(configdir.All)[0]
 }
 
 func initLogger() {
@@ -55,11 +78,16 @@ func initCtx() {
 	ctx, cancel = context.WithCancel(context.Background())
 
 	// Make sure we terminate gracefully on signals by canceling the context.
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
+	// Running commands are asked to terminate, and killed on a second
+	// signal or when they don't terminate in time.
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
 		s := <-ch
 		log.Info().Msgf("Received %v signal: shutting down", s)
 		cancel()
+		s = <-ch
+		log.Warn().Msgf("Received %v signal: killing running commands", s)
+		close(forceStop)
 	}()
 }
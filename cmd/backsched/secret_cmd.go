@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"github.com/mbrt/backsched/internal/config"
+)
+
+var secretRecipients []string
+
+var secretCmd = &cobra.Command{
+	Use:   "secret",
+	Short: "Manage the encrypted values in the config",
+}
+
+var secretEncryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt a value read from stdin, to be used in the config",
+	Long: `Encrypt a value read from stdin, to be used in the config.
+
+The output is a Jsonnet expression, decrypted with the local identity file
+when the config is parsed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runSecretEncrypt(); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	},
+}
+
+var secretKeygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate the identity file decrypting the config values",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runSecretKeygen(); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(secretCmd)
+	secretCmd.AddCommand(secretEncryptCmd, secretKeygenCmd)
+
+	secretEncryptCmd.Flags().StringArrayVarP(&secretRecipients, "recipient", "r", nil,
+		"age public key to encrypt to. Defaults to the local identity.")
+}
+
+func runSecretEncrypt() error {
+	rs, err := recipients()
+	if err != nil {
+		return err
+	}
+	val, err := readValue()
+	if err != nil {
+		return err
+	}
+	ct, err := config.Encrypt(val, rs)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("std.native('decrypt')(|||")
+	for _, line := range strings.Split(strings.TrimSpace(ct), "\n") {
+		fmt.Printf("  %s\n", line)
+	}
+	fmt.Println("|||)")
+	return nil
+}
+
+func recipients() ([]age.Recipient, error) {
+	var res []age.Recipient
+	for _, r := range secretRecipients {
+		rec, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, fmt.Errorf("parsing recipient %q: %w", r, err)
+		}
+		res = append(res, rec)
+	}
+	if len(res) > 0 {
+		return res, nil
+	}
+
+	// Encrypt to the local identity.
+	opts, err := evalOpts()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range opts.Identities {
+		if x, ok := id.(*age.X25519Identity); ok {
+			res = append(res, x.Recipient())
+		}
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no recipient given, and no identity found in %q: run `backsched secret keygen`",
+			path.Join(cfgDir.Path, identityFile))
+	}
+	return res, nil
+}
+
+// readValue reads the value to encrypt, without echoing it on a terminal.
+func readValue() (string, error) {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "Value: ")
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+	b, err := ioutil.ReadAll(os.Stdin)
+	return string(b), err
+}
+
+func runSecretKeygen() error {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfgDir.Path, 0o700); err != nil {
+		return err
+	}
+	p := path.Join(cfgDir.Path, identityFile)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("identity file %q already exists", p)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "# public key: %s\n%s\n", id.Recipient(), id); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Info().Msgf("Identity written to %q", p)
+	fmt.Println(id.Recipient())
+	return nil
+}
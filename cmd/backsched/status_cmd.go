@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/mbrt/backsched/internal/backup"
+	"github.com/mbrt/backsched/internal/config"
+)
+
+var (
+	statusJSON     bool
+	statusAllHosts bool
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Print the status of all the configured backups",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runStatus(); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+
+	statusCmd.Flags().BoolVarP(&statusJSON, "json", "", false, "print the status in JSON format.")
+	statusCmd.Flags().BoolVarP(&statusAllHosts, "all-hosts", "", false, "include the backups meant for other hosts.")
+}
+
+func runStatus() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(cfg)
+	if err != nil {
+		return err
+	}
+	st, err := backup.ComputeStatus(ctx, cfg, env, statusAllHosts)
+	if err != nil {
+		return err
+	}
+	if statusJSON {
+		b, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	header := "NAME\tLAST SUCCESS\tLAST RUN\tOUTDATED\tVERIFY"
+	if statusAllHosts {
+		header += "\tTHIS HOST"
+	}
+	fmt.Fprintln(w, header)
+	for _, s := range st {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s",
+			s.Name, fmtTime(s.LastSuccess), fmtRun(s.LastRun), s.Outdated, fmtVerify(s.Verify))
+		if statusAllHosts {
+			fmt.Fprintf(w, "\t%v", !s.OtherHost)
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
+
+func fmtTime(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func fmtRun(r *config.RunInfo) string {
+	if r == nil {
+		return "-"
+	}
+	if r.Interrupted {
+		return "interrupted"
+	}
+	if r.RequirementLost {
+		return "aborted (requirement lost)"
+	}
+	if r.Error != "" {
+		return fmt.Sprintf("failed (exit status %d)", r.ExitStatus)
+	}
+	return "ok"
+}
+
+func fmtVerify(v *backup.VerifyStatus) string {
+	if v == nil {
+		return "-"
+	}
+	res := fmtRun(v.LastRun)
+	if v.Due {
+		res += " (due)"
+	}
+	return res
+}
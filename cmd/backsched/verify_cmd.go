@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/mbrt/backsched/internal/backup"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [name...]",
+	Short: "Runs the restore tests of the given backups, or the ones that are due",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runVerify(args); err != nil {
+			log.Fatal().Err(err).Msg("")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().BoolVarP(&dryRun, "dry-run", "", false, "only simulate the verification.")
+	verifyCmd.Flags().BoolVarP(&askSecrets, "ask-secrets", "", true, "whether to interactively ask secrets.")
+}
+
+func runVerify(names []string) error {
+	cfg, err := loadConfigWith(dryRun)
+	if err != nil {
+		return err
+	}
+	env, err := newEnv(cfg)
+	if err != nil {
+		return err
+	}
+	return backup.Verify(ctx, cfg, env, backup.Opts{
+		DryRun:     dryRun,
+		AskSecrets: askSecrets,
+	}, names)
+}
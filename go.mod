@@ -3,6 +3,7 @@ module github.com/mbrt/backsched
 go 1.16
 
 require (
+	filippo.io/age v1.0.0
 	github.com/gen2brain/beeep v0.0.0-20200526185328-e9c15c258e28
 	github.com/google/go-jsonnet v0.17.0
 	github.com/jonboulle/clockwork v0.2.2
@@ -11,5 +12,7 @@ require (
 	github.com/spf13/afero v1.5.1
 	github.com/spf13/cobra v1.1.3
 	github.com/stretchr/testify v1.7.0
-	golang.org/x/term v0.0.0-20210220032956-6a3ed077a48d
+	golang.org/x/sys v0.0.0-20210903071746-97244b99971b
+	golang.org/x/term v0.0.0-20210615171337-6886f2dfbf5b
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
@@ -18,7 +18,10 @@ install -d "${configdir}"
 if [ ! -f "${configdir}/config.jsonnet" ]; then
     install -T -m 600 config-default.jsonnet "${configdir}/config.jsonnet"
 fi
-install -T -m 600 backsched.libsonnet "${configdir}/backsched.libsonnet"
+# backsched.libsonnet is bundled in the binary: a local copy overrides it
+if [ -f "${configdir}/backsched.libsonnet" ]; then
+    echo "warning: ${configdir}/backsched.libsonnet overrides the bundled library" >&2
+fi
 
 # install the service file
 install -d "${unitdir}"
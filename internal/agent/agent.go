@@ -0,0 +1,209 @@
+// Package agent implements an in-memory secret store, similar to ssh-agent.
+//
+// Secrets are unlocked once, and then served to unattended backup runs
+// through a unix socket, until they expire.
+//
+// The stored values are kept in locked memory where supported, so that they
+// are never swapped to disk, and zeroed when forgotten. The short-lived copies
+// made when decoding requests and encoding responses are left to the garbage
+// collector.
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/rs/zerolog/log"
+
+	"github.com/mbrt/backsched/internal/config"
+)
+
+// Secret is a secret value. Backup is empty for global secrets.
+type Secret struct {
+	Backup string `json:"backup,omitempty"`
+	ID     string `json:"id"`
+	Value  string `json:"value"`
+}
+
+// Agent holds the unlocked secrets in memory, and wipes them when expired.
+type Agent struct {
+	clock clockwork.Clock
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	secrets map[key]*entry
+}
+
+type key struct {
+	Backup string
+	ID     string
+}
+
+type entry struct {
+	value []byte
+	// locked is true if value was allocated with allocLocked.
+	locked  bool
+	expires time.Time
+}
+
+func newEntry(value string, expires time.Time) *entry {
+	e := &entry{expires: expires}
+	v, err := allocLocked(len(value))
+	if err != nil {
+		log.Warn().Err(err).Msg("Locking secret memory")
+		v = make([]byte, len(value))
+	} else {
+		e.locked = true
+	}
+	copy(v, value)
+	e.value = v
+	return e
+}
+
+// wipe zeroes the secret memory and releases it.
+func (e *entry) wipe() {
+	for i := range e.value {
+		e.value[i] = 0
+	}
+	if e.locked {
+		freeLocked(e.value)
+	}
+	e.value = nil
+}
+
+// New creates a new agent. Secrets expire after the given TTL, unless a
+// different one is requested when adding them.
+func New(clock clockwork.Clock, ttl time.Duration) *Agent {
+	return &Agent{
+		clock:   clock,
+		ttl:     ttl,
+		secrets: map[key]*entry{},
+	}
+}
+
+// Handler returns the HTTP handler serving the agent protocol.
+func (a *Agent) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/secret", a.handleSecret)
+	mux.HandleFunc("/v1/secrets", a.handleSecrets)
+	return mux
+}
+
+// Expire wipes the expired secrets.
+func (a *Agent) Expire() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.clock.Now()
+	for k, e := range a.secrets {
+		if !now.Before(e.expires) {
+			e.wipe()
+			delete(a.secrets, k)
+		}
+	}
+}
+
+// Lock wipes all the secrets.
+func (a *Agent) Lock() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, e := range a.secrets {
+		e.wipe()
+		delete(a.secrets, k)
+	}
+}
+
+func (a *Agent) add(secrets []Secret, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = a.ttl
+	}
+	expires := a.clock.Now().Add(ttl)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, s := range secrets {
+		k := key{Backup: s.Backup, ID: s.ID}
+		if old, ok := a.secrets[k]; ok {
+			old.wipe()
+		}
+		a.secrets[k] = newEntry(s.Value, expires)
+	}
+}
+
+func (a *Agent) remove(k key) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if e, ok := a.secrets[k]; ok {
+		e.wipe()
+		delete(a.secrets, k)
+	}
+}
+
+func (a *Agent) get(k key) (string, bool) {
+	a.Expire()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.secrets[k]
+	if !ok {
+		return "", false
+	}
+	return string(e.value), true
+}
+
+// addRequest is the body of a request adding secrets.
+type addRequest struct {
+	Secrets []Secret `json:"secrets"`
+	// TTL overrides the default TTL of the agent, if non-zero.
+	TTL config.Duration `json:"ttl,omitempty"`
+}
+
+func (a *Agent) handleSecret(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	k := key{Backup: q.Get("backup"), ID: q.Get("id")}
+	switch r.Method {
+	case http.MethodGet:
+		v, ok := a.get(k)
+		if !ok {
+			writeError(w, http.StatusNotFound, "secret not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"value": v})
+	case http.MethodDelete:
+		a.remove(k)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "removed"})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *Agent) handleSecrets(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req addRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		a.add(req.Secrets, time.Duration(req.TTL))
+		writeJSON(w, http.StatusOK, map[string]int{"added": len(req.Secrets)})
+	case http.MethodDelete:
+		a.Lock()
+		writeJSON(w, http.StatusOK, map[string]string{"status": "locked"})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("Writing response")
+	}
+}
@@ -0,0 +1,76 @@
+package agent_test
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mbrt/backsched/internal/agent"
+)
+
+func TestAgent(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	a := agent.New(clock, time.Hour)
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	require.Nil(t, err)
+	srv := &http.Server{Handler: a.Handler()}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+
+	c := agent.NewClient(sock)
+	_, err = c.Secret("b1", "pass")
+	assert.ErrorIs(t, err, agent.ErrNotFound)
+
+	err = c.Add([]agent.Secret{
+		{Backup: "b1", ID: "pass", Value: "secret1"},
+		{ID: "pass", Value: "global"},
+	}, 0)
+	require.Nil(t, err)
+	v, err := c.Secret("b1", "pass")
+	require.Nil(t, err)
+	assert.Equal(t, "secret1", v)
+	v, err = c.Secret("", "pass")
+	require.Nil(t, err)
+	assert.Equal(t, "global", v)
+	_, err = c.Secret("b2", "pass")
+	assert.ErrorIs(t, err, agent.ErrNotFound)
+
+	// Values can be replaced, and be empty.
+	require.Nil(t, c.Add([]agent.Secret{{Backup: "b1", ID: "pass", Value: "secret1b"}}, 0))
+	require.Nil(t, c.Add([]agent.Secret{{Backup: "b1", ID: "empty"}}, 0))
+	v, err = c.Secret("b1", "pass")
+	require.Nil(t, err)
+	assert.Equal(t, "secret1b", v)
+	v, err = c.Secret("b1", "empty")
+	require.Nil(t, err)
+	assert.Equal(t, "", v)
+
+	// Single secrets can be removed.
+	require.Nil(t, c.Remove("", "pass"))
+	_, err = c.Secret("", "pass")
+	assert.ErrorIs(t, err, agent.ErrNotFound)
+	_, err = c.Secret("b1", "pass")
+	require.Nil(t, err)
+
+	// Secrets expire after the TTL.
+	err = c.Add([]agent.Secret{{Backup: "b2", ID: "pass", Value: "secret2"}}, 3*time.Hour)
+	require.Nil(t, err)
+	clock.Advance(2 * time.Hour)
+	_, err = c.Secret("b1", "pass")
+	assert.ErrorIs(t, err, agent.ErrNotFound)
+	v, err = c.Secret("b2", "pass")
+	require.Nil(t, err)
+	assert.Equal(t, "secret2", v)
+
+	// Locking wipes everything.
+	require.Nil(t, c.Lock())
+	_, err = c.Secret("b2", "pass")
+	assert.ErrorIs(t, err, agent.ErrNotFound)
+}
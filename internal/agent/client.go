@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mbrt/backsched/internal/config"
+)
+
+// ErrNotFound is returned when the agent doesn't hold the requested secret.
+var ErrNotFound = errors.New("secret not found in the agent")
+
+// Client talks to an agent listening on a unix socket.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient creates a client for the agent listening on the given socket.
+func NewClient(socket string) Client {
+	return Client{
+		http: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Secret returns the value of a secret. Backup is empty for global secrets.
+func (c Client) Secret(backup, id string) (string, error) {
+	q := url.Values{"backup": {backup}, "id": {id}}
+	resp, err := c.http.Get("http://agent/v1/secret?" + q.Encode())
+	if err != nil {
+		return "", fmt.Errorf("querying agent: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrNotFound
+	}
+	var res struct {
+		Value string `json:"value"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("decoding agent response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("agent error: %s", res.Error)
+	}
+	return res.Value, nil
+}
+
+// Add adds secrets to the agent. A zero TTL uses the default of the agent.
+func (c Client) Add(secrets []Secret, ttl time.Duration) error {
+	b, err := json.Marshal(addRequest{Secrets: secrets, TTL: config.Duration(ttl)})
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Post("http://agent/v1/secrets", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("adding secrets to agent: %w", err)
+	}
+	return checkResponse(resp)
+}
+
+// Remove removes a secret from the agent, e.g. because it's not valid.
+// Backup is empty for global secrets.
+func (c Client) Remove(backup, id string) error {
+	q := url.Values{"backup": {backup}, "id": {id}}
+	req, err := http.NewRequest(http.MethodDelete, "http://agent/v1/secret?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("removing secret from agent: %w", err)
+	}
+	return checkResponse(resp)
+}
+
+// Lock wipes all the secrets from the agent.
+func (c Client) Lock() error {
+	req, err := http.NewRequest(http.MethodDelete, "http://agent/v1/secrets", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("locking agent: %w", err)
+	}
+	return checkResponse(resp)
+}
+
+func checkResponse(resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var res struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("agent error: %s", resp.Status)
+	}
+	return fmt.Errorf("agent error: %s", res.Error)
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package agent
+
+// Memory locking is not supported on this platform.
+func allocLocked(n int) ([]byte, error) { return make([]byte, n), nil }
+
+func freeLocked([]byte) {}
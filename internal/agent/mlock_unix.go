@@ -0,0 +1,33 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package agent
+
+import "golang.org/x/sys/unix"
+
+// allocLocked returns a buffer of n bytes locked in memory, so that it's
+// never swapped to disk. Every buffer has its own mapping: unlocking one
+// never unlocks the pages of another.
+func allocLocked(n int) ([]byte, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	b, err := unix.Mmap(-1, 0, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Mlock(b); err != nil {
+		_ = unix.Munmap(b)
+		return nil, err
+	}
+	return b, nil
+}
+
+// freeLocked unlocks and releases a buffer returned by allocLocked.
+func freeLocked(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	_ = unix.Munlock(b)
+	_ = unix.Munmap(b)
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Listen listens on the given address. Addresses in the form `unix:<path>`
+// are unix sockets, accessible by the current user only. Everything else is
+// a TCP address.
+func Listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	p := strings.TrimPrefix(addr, "unix:")
+	// Remove a stale socket from a previous run.
+	if fi, err := os.Stat(p); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(p); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+	l, err := net.Listen("unix", p)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(p, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,246 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/mbrt/backsched/internal/backup"
+	"github.com/mbrt/backsched/internal/config"
+)
+
+// RequestHeader must be set, to any value, in the requests changing the
+// state of the server. Browsers can't send custom headers cross-origin
+// without a CORS preflight, which the server never allows, so a web page
+// can't trigger or cancel runs on the user's behalf.
+const RequestHeader = "X-Backsched-Request"
+
+// Server serves the API. Backup runs triggered through it happen in the
+// background, one at a time.
+type Server struct {
+	cfg  config.Config
+	env  backup.Env
+	opts backup.Opts
+
+	// ctx is the parent context of all the runs.
+	ctx context.Context
+
+	mu      sync.Mutex
+	run     *runState
+	lastRun *runState
+}
+
+// runState is the state of a run triggered by the server.
+type runState struct {
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// New creates a new server. The given context bounds all the runs.
+func New(ctx context.Context, cfg config.Config, env backup.Env, opts backup.Opts) *Server {
+	return &Server{
+		cfg:  cfg,
+		env:  env,
+		opts: opts,
+		ctx:  ctx,
+	}
+}
+
+// Handler returns the HTTP handler serving the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/backups", s.handleBackups)
+	mux.HandleFunc("/api/v1/backups/", s.handleHistory)
+	mux.HandleFunc("/api/v1/status", s.handleStatus)
+	mux.HandleFunc("/api/v1/run", s.handleRun)
+	mux.HandleFunc("/api/v1/cancel", s.handleCancel)
+	return mux
+}
+
+// Trigger starts a backup run in the background. Returns false if a run is
+// already in progress.
+func (s *Server) Trigger() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.run != nil {
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	run := &runState{
+		Started: s.env.Clock.Now(),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	s.run = run
+
+	go func() {
+		defer close(run.done)
+		defer cancel()
+		err := backup.Run(ctx, s.cfg, s.env, s.opts)
+		if err != nil {
+			log.Error().Err(err).Msg("Backup run")
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		now := s.env.Clock.Now()
+		run.Finished = &now
+		if err != nil {
+			run.Error = err.Error()
+		}
+		s.lastRun = run
+		s.run = nil
+	}()
+	return true
+}
+
+// Cancel cancels the run in progress and waits for it to terminate.
+// Returns false if no run is in progress.
+func (s *Server) Cancel() bool {
+	s.mu.Lock()
+	run := s.run
+	s.mu.Unlock()
+	if run == nil {
+		return false
+	}
+	run.cancel()
+	<-run.done
+	return true
+}
+
+// Wait waits for the run in progress, if any, to terminate.
+func (s *Server) Wait() {
+	s.mu.Lock()
+	run := s.run
+	s.mu.Unlock()
+	if run != nil {
+		<-run.done
+	}
+}
+
+// statusResponse is the response of the status endpoint.
+type statusResponse struct {
+	Running bool            `json:"running"`
+	Run     *runState       `json:"run,omitempty"`
+	LastRun *runState       `json:"lastRun,omitempty"`
+	Backups []backup.Status `json:"backups"`
+}
+
+// handleBackups lists all the backups with their schedule and state. The
+// config itself is never exposed, as it may contain decrypted values.
+func (s *Server) handleBackups(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	st, err := backup.ComputeStatus(r.Context(), s.cfg, s.env, true)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	// The path is /api/v1/backups/<name>/history.
+	rest := strings.TrimPrefix(r.URL.Path, "/api/v1/backups/")
+	if !strings.HasSuffix(rest, "/history") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	name := strings.TrimSuffix(rest, "/history")
+	runs, err := backup.History(r.Context(), s.cfg, s.env, name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if runs == nil {
+		runs = []config.RunInfo{}
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	allHosts := r.URL.Query().Get("allHosts") == "true"
+	st, err := backup.ComputeStatus(r.Context(), s.cfg, s.env, allHosts)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Encode while holding the lock, as the run state may change.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := statusResponse{
+		Running: s.run != nil,
+		Run:     s.run,
+		LastRun: s.lastRun,
+		Backups: st,
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) || !checkRequestHeader(w, r) {
+		return
+	}
+	if !s.Trigger() {
+		writeError(w, http.StatusConflict, "a backup run is already in progress")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "started"})
+}
+
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) || !checkRequestHeader(w, r) {
+		return
+	}
+	if !s.Cancel() {
+		writeError(w, http.StatusConflict, "no backup run in progress")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "canceled"})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func checkRequestHeader(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get(RequestHeader) != "" {
+		return true
+	}
+	writeError(w, http.StatusForbidden, "missing "+RequestHeader+" header")
+	return false
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("Writing response")
+	}
+}
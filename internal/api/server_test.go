@@ -0,0 +1,151 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mbrt/backsched/internal/api"
+	"github.com/mbrt/backsched/internal/backup"
+	"github.com/mbrt/backsched/internal/config"
+	"github.com/mbrt/backsched/internal/exec"
+)
+
+// blockingRunner blocks every command until the context is canceled, or
+// the command is released.
+type blockingRunner struct {
+	started chan string
+	release chan struct{}
+}
+
+func (b blockingRunner) Run(ctx context.Context, cmd exec.Cmd) error {
+	b.started <- cmd.Cmd
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.release:
+		return nil
+	}
+}
+
+type memSio struct {
+	fs afero.Fs
+}
+
+func (m memSio) Save(buf []byte) error {
+	return afero.WriteFile(m.fs, "/state", buf, 0o600)
+}
+
+func (m memSio) Load() ([]byte, error) {
+	return afero.ReadFile(m.fs, "/state")
+}
+
+func testConfig() config.Config {
+	return config.Config{
+		Version: config.Version,
+		Backups: []config.Backup{
+			{
+				Name:     "b1",
+				Interval: config.Duration(3600e9),
+				Commands: []config.Command{{Cmd: "cmd1"}},
+			},
+			{
+				Name:     "b2",
+				Interval: config.Duration(3600e9),
+				Commands: []config.Command{{Cmd: "cmd2"}},
+			},
+		},
+	}
+}
+
+func doJSON(t *testing.T, method, url string, v interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	require.Nil(t, err)
+	req.Header.Set(api.RequestHeader, "1")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	if v != nil {
+		require.Nil(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func TestServer(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	runner := blockingRunner{
+		started: make(chan string, 1),
+		release: make(chan struct{}),
+	}
+	env := backup.Env{
+		Sio:    memSio{fs},
+		Clock:  clockwork.NewFakeClock(),
+		Fs:     fs,
+		Runner: runner,
+	}
+	srv := api.New(context.Background(), testConfig(), env, backup.Opts{})
+	hs := httptest.NewServer(srv.Handler())
+	defer hs.Close()
+
+	var backups []map[string]interface{}
+	assert.Equal(t, http.StatusOK, doJSON(t, "GET", hs.URL+"/api/v1/backups", &backups))
+	require.Len(t, backups, 2)
+	assert.Equal(t, "b1", backups[0]["name"])
+	assert.Equal(t, "1h0m0s", backups[0]["interval"])
+	// The commands are not exposed.
+	assert.NotContains(t, backups[0], "commands")
+
+	var status struct {
+		Running bool            `json:"running"`
+		Backups []backup.Status `json:"backups"`
+	}
+	assert.Equal(t, http.StatusOK, doJSON(t, "GET", hs.URL+"/api/v1/status", &status))
+	assert.False(t, status.Running)
+	assert.True(t, status.Backups[0].Outdated)
+	assert.Nil(t, status.Backups[0].LastSuccess)
+
+	// Nothing to cancel.
+	assert.Equal(t, http.StatusConflict, doJSON(t, "POST", hs.URL+"/api/v1/cancel", nil))
+	// Wrong method.
+	assert.Equal(t, http.StatusMethodNotAllowed, doJSON(t, "GET", hs.URL+"/api/v1/run", nil))
+	// Simple cross-site requests are rejected.
+	resp, err := http.Post(hs.URL+"/api/v1/run", "text/plain", nil)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Start a run and let the first backup complete.
+	assert.Equal(t, http.StatusAccepted, doJSON(t, "POST", hs.URL+"/api/v1/run", nil))
+	assert.Equal(t, "cmd1", <-runner.started)
+	// A second run can't start.
+	assert.Equal(t, http.StatusConflict, doJSON(t, "POST", hs.URL+"/api/v1/run", nil))
+	assert.Equal(t, http.StatusOK, doJSON(t, "GET", hs.URL+"/api/v1/status", &status))
+	assert.True(t, status.Running)
+	runner.release <- struct{}{}
+
+	// Cancel the run during the second backup.
+	assert.Equal(t, "cmd2", <-runner.started)
+	assert.Equal(t, http.StatusOK, doJSON(t, "POST", hs.URL+"/api/v1/cancel", nil))
+
+	assert.Equal(t, http.StatusOK, doJSON(t, "GET", hs.URL+"/api/v1/status", &status))
+	assert.False(t, status.Running)
+	assert.False(t, status.Backups[0].Outdated)
+	assert.True(t, status.Backups[1].Outdated)
+
+	var runs []config.RunInfo
+	assert.Equal(t, http.StatusOK, doJSON(t, "GET", hs.URL+"/api/v1/backups/b1/history", &runs))
+	require.Len(t, runs, 1)
+	assert.Equal(t, "", runs[0].Error)
+	assert.Equal(t, http.StatusOK, doJSON(t, "GET", hs.URL+"/api/v1/backups/b2/history", &runs))
+	require.Len(t, runs, 1)
+	assert.Contains(t, runs[0].Error, "context canceled")
+	assert.Equal(t, http.StatusNotFound, doJSON(t, "GET", hs.URL+"/api/v1/backups/b3/history", nil))
+}
@@ -2,9 +2,12 @@ package backup
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/jonboulle/clockwork"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/afero"
 
@@ -13,7 +16,20 @@ import (
 )
 
 // Run runs the given backup configuration.
+//
+// Shared state stores are locked for the whole run, so that multiple machines
+// don't run the same backups at the same time.
 func Run(ctx context.Context, cfg config.Config, env Env, opts Opts) error {
+	cfg = forHost(cfg, env.Host)
+	if !opts.DryRun {
+		unlock, err := lockState(ctx, env.Sio)
+		if err != nil {
+			return fmt.Errorf("%w (another machine may be running backups)", err)
+		}
+		defer unlock()
+	}
+	// Find out what's outdated only once locked, as another machine may have
+	// just completed some of the backups.
 	backups, err := ComputeOutdated(ctx, cfg, env)
 	if err != nil {
 		return err
@@ -26,32 +42,121 @@ func Run(ctx context.Context, cfg config.Config, env Env, opts Opts) error {
 	} else {
 		// Make sure we update the state at the end.
 		state = loadState(env.Sio)
-		defer saveState(env.Sio, state)
+		defer func() {
+			saveState(env.Sio, state)
+			if cfg.Metrics != nil && cfg.Metrics.Textfile != "" {
+				writeMetricsFile(env, cfg, state, cfg.Metrics.Textfile)
+			}
+		}()
 	}
 
+	// Pre-flight: find out what can run, and ask all the secrets up front.
+	var runnable []config.Backup
 	for _, bc := range backups {
-		name := bc.Backup.Name
+		b := newExecutorFromConfig(bc.Backup, env, secretVals{})
+		if err := b.CanExecute(ctx); err != nil {
+			log.Info().Str("backup", bc.Backup.Name).Msgf("Skipping because: %v", err)
+			continue
+		}
+		runnable = append(runnable, bc.Backup)
+	}
+	// Use the state updated by the backups, as the dry run one is empty.
+	vstate := state
+	if opts.DryRun {
+		vstate = loadState(env.Sio)
+	}
+	// The verifications of the runnable backups may be due once they
+	// complete, so their secrets are collected in any case.
+	toAsk := append([]config.Backup{}, runnable...)
+	if !opts.SkipVerify {
+		toAsk = append(toAsk, dueVerifications(cfg, vstate, env.Clock.Now())...)
+	}
+	secrets, err := collectSecrets(ctx, toAsk, env, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, bc := range runnable {
+		name := bc.Name
 		clog := log.With().Str("backup", name).Logger()
 
-		b := newExecutorFromConfig(bc.Backup, env, opts)
+		if err := secrets.check(name, bc.Commands); err != nil {
+			clog.Error().Msgf("Skipping because: %v", err)
+			continue
+		}
+		b := newExecutorFromConfig(bc, env, secrets)
+		// Requirements may have changed while running the previous backups.
 		if err := b.CanExecute(ctx); err != nil {
 			clog.Info().Msgf("Skipping because: %v", err)
 			continue
 		}
-		clog.Info().Msg("Executing")
-		if err := b.Run(ctx); err != nil {
+		start := env.Clock.Now()
+		cp := config.Checkpoint{
+			Start:  start,
+			Digest: config.CommandsDigest(bc.Commands),
+		}
+		if prev := resumeFrom(bc, vstate[name].Checkpoint, cp.Digest, opts, start, clog); prev != nil {
+			cp = *prev
+			b.Start = prev.Completed
+		}
+		if b.Start > 0 {
+			clog.Info().Msgf("Resuming from command %d of %d", b.Start+1, len(b.Cfg.Cmds))
+		} else {
+			clog.Info().Msg("Executing")
+		}
+		var hb *heartbeat
+		if !opts.DryRun {
+			hb = newHeartbeat(bc.Heartbeat, clog)
+			if b.Start == 0 {
+				// Forget the progress of previous runs.
+				state.SetCheckpoint(name, nil)
+			}
+			b.Completed = func(n int) {
+				cp.Completed = n
+				cp.Updated = env.Clock.Now()
+				c := cp
+				state.SetCheckpoint(name, &c)
+				// Save right away, in case we don't get to the end.
+				saveState(env.Sio, state)
+			}
+		}
+		for i := range b.Cfg.Cmds {
+			b.Cfg.Cmds[i].Output = hb.Output()
+		}
+		hb.Start(ctx)
+		err := b.Run(ctx)
+		info := runInfo(ctx, start, env.Clock.Now(), err)
+		state.RecordRun(name, info)
+		hb.Done(ctx, err)
+		if info.Interrupted {
+			clog.Warn().Msg("Interrupted")
+			return fmt.Errorf("backup %q interrupted: %w", name, err)
+		}
+		if info.RequirementLost {
+			clog.Error().Err(err).Msg("Aborted")
+			return fmt.Errorf("backup %q aborted: %w", name, err)
+		}
+		if err != nil {
 			return fmt.Errorf("executing backup %q: %w", name, err)
 		}
-		state[name] = env.Clock.Now()
 	}
 
-	return nil
+	if opts.SkipVerify {
+		return nil
+	}
+	return runVerifications(ctx, dueVerifications(cfg, vstate, env.Clock.Now()), env, opts, secrets, state)
 }
 
 // Opts groups contains backup options.
 type Opts struct {
 	DryRun     bool
 	AskSecrets bool
+	// SkipVerify avoids running the verifications that are due after the
+	// backups.
+	SkipVerify bool
+	// Resume continues the backups from the last checkpoint, even when not
+	// configured as resumable.
+	Resume bool
 }
 
 // Env groups together the environment a backup is ran against.
@@ -61,6 +166,9 @@ type Env struct {
 	Fs      afero.Fs
 	Runner  exec.Runner
 	Secrets SecretGetter
+	// Host is the machine backups run on. Backups not meant for it are
+	// ignored.
+	Host config.Host
 }
 
 // StateIOer abstracts away lower level save and load functionality for the
@@ -70,9 +178,74 @@ type StateIOer interface {
 	Load() ([]byte, error)
 }
 
-// SecretGetter returns the value of a secret.
+// StateLocker is implemented by StateIOers shared among multiple machines.
+// The lock is held for the whole duration of the runs and state updates.
+type StateLocker interface {
+	Lock(ctx context.Context) (unlock func() error, err error)
+}
+
+const (
+	// stateLockTimeout is the maximum time to wait for a state lock.
+	stateLockTimeout = 5 * time.Minute
+	// requirementsCheckInterval is how often the requirements of a running
+	// backup are checked again.
+	requirementsCheckInterval = 10 * time.Second
+)
+
+// SecretGetter returns the value of a secret. The backup is empty for global
+// secrets.
+//
+// An error, e.g. because the user canceled the prompt, stops the run before
+// any backup starts.
 type SecretGetter interface {
-	Secret(backup string, s config.Secret) string
+	Secret(backup string, s config.Secret) (string, error)
+}
+
+// SecretInvalidator is implemented by SecretGetters caching the secrets, e.g.
+// in an agent. Invalidate forgets a value that failed validation, so that the
+// following request asks the user again.
+type SecretInvalidator interface {
+	Invalidate(backup string, s config.Secret)
+}
+
+// runInfo returns the outcome of a run. Failures happening after ctx is
+// canceled are considered interruptions, and the ones caused by a lost
+// requirement are told apart from command failures.
+func runInfo(ctx context.Context, start, end time.Time, err error) config.RunInfo {
+	res := config.RunInfo{
+		Start:      start,
+		Duration:   config.Duration(end.Sub(start)),
+		ExitStatus: exec.ExitStatus(err),
+	}
+	if err != nil {
+		res.Error = err.Error()
+		res.Interrupted = ctx.Err() != nil
+		var rerr *exec.RequirementError
+		res.RequirementLost = errors.As(err, &rerr)
+	}
+	return res
+}
+
+// resumeFrom returns the checkpoint to resume from, or nil if the run should
+// start over. Resumable backups only resume automatically when the checkpoint
+// is more recent than their interval: older progress is likely stale (e.g.
+// the data changed in the meantime). Opts.Resume always resumes.
+func resumeFrom(bc config.Backup, cp *config.Checkpoint, digest string, opts Opts, now time.Time, clog zerolog.Logger) *config.Checkpoint {
+	if !opts.Resume && !bc.Resumable {
+		return nil
+	}
+	if cp == nil || cp.Completed == 0 {
+		return nil
+	}
+	if cp.Digest != digest {
+		clog.Warn().Msg("Commands changed since the last incomplete run, starting over")
+		return nil
+	}
+	if !opts.Resume && now.Sub(cp.Updated) >= time.Duration(bc.Interval) {
+		clog.Info().Msgf("Last incomplete run is older than the interval (%v), starting over", time.Duration(bc.Interval))
+		return nil
+	}
+	return cp
 }
 
 func loadState(sio StateIOer) config.State {
@@ -89,7 +262,19 @@ func loadState(sio StateIOer) config.State {
 	return state
 }
 
+// saveState saves the state. Shared stores must be locked by the caller.
 func saveState(sio StateIOer, s config.State) {
+	if _, ok := sio.(StateLocker); ok {
+		// Other machines may have updated the state in the meantime, if our
+		// lock was broken.
+		if buf, err := sio.Load(); err == nil {
+			if cur, err := config.LoadState(buf); err == nil {
+				cur.Merge(s)
+				s = cur
+			}
+		}
+	}
+
 	buf, err := s.Save()
 	if err != nil {
 		log.Error().Err(err).Msgf("Serializing state file")
@@ -99,7 +284,9 @@ func saveState(sio StateIOer, s config.State) {
 	}
 }
 
-func newExecutorFromConfig(bc config.Backup, env Env, opts Opts) exec.Executor {
+// newExecutorFromConfig creates the executor of a backup, using the already
+// collected secret values.
+func newExecutorFromConfig(bc config.Backup, env Env, secrets secretVals) exec.Executor {
 	var reqs []exec.Requirement
 	for _, r := range bc.Requires {
 		if r.Path != nil {
@@ -107,33 +294,19 @@ func newExecutorFromConfig(bc config.Backup, env Env, opts Opts) exec.Executor {
 		}
 	}
 
-	secrets := map[string]string{}
-	if opts.AskSecrets {
-		if opts.DryRun {
-			secrets = collectSecretVals(bc, dryRunner{})
-		} else {
-			secrets = collectSecretVals(bc, env.Secrets)
-		}
-	}
-
 	var cmds []exec.Cmd
 	for _, c := range bc.Commands {
-		// Map the secret environment to the already collected secret values.
-		// The match is done by ID.
-		secEnv := map[string]string{}
-		for env, sec := range c.SecretEnv {
-			// It's possible the secret is not present, if we didn't ask them
-			// in the first place.
-			if val, ok := secrets[sec.ID]; ok {
-				secEnv[env] = val
-			}
-		}
+		// Map the secrets to the already collected secret values. It's
+		// possible the secrets are not present, if we didn't ask them in the
+		// first place.
 		cmds = append(cmds, exec.Cmd{
-			Cmd:       c.Cmd,
-			Args:      c.Args,
-			Env:       c.Env,
-			Workdir:   c.Workdir,
-			SecretEnv: secEnv,
+			Cmd:         c.Cmd,
+			Args:        c.Args,
+			Env:         c.Env,
+			Workdir:     c.Workdir,
+			SecretEnv:   secrets.lookupAll(bc.Name, c.SecretEnv),
+			SecretFiles: secrets.lookupAll(bc.Name, c.SecretFiles),
+			SecretStdin: secrets.lookup(bc.Name, c.SecretStdin),
 		})
 	}
 
@@ -142,25 +315,13 @@ func newExecutorFromConfig(bc config.Backup, env Env, opts Opts) exec.Executor {
 			Reqs: reqs,
 			Cmds: cmds,
 		},
-		Fs:     env.Fs,
-		Runner: env.Runner,
+		Fs:      env.Fs,
+		Runner:  env.Runner,
+		Monitor: requirementsCheckInterval,
+		Clock:   env.Clock,
 	}
 }
 
-func collectSecretVals(bc config.Backup, sg SecretGetter) map[string]string {
-	res := map[string]string{}
-	for _, cmd := range bc.Commands {
-		for _, s := range cmd.SecretEnv {
-			if _, ok := res[s.ID]; ok {
-				// We already know about this secret.
-				continue
-			}
-			res[s.ID] = sg.Secret(bc.Name, s)
-		}
-	}
-	return res
-}
-
 type dryRunner struct{}
 
 // Run runs a command as a subprocess.
@@ -170,12 +331,14 @@ func (dryRunner) Run(ctx context.Context, cmd exec.Cmd) error {
 		Str("args", fmt.Sprintf("%v", cmd.Args)).
 		Str("env", fmt.Sprintf("%v", cmd.Env)).
 		Str("secrets", fmt.Sprintf("%v", keys(cmd.SecretEnv))).
+		Str("secretFiles", fmt.Sprintf("%v", keys(cmd.SecretFiles))).
+		Bool("secretStdin", cmd.SecretStdin != nil).
 		Msg("Would have run the command")
 	return nil
 }
 
-func (dryRunner) Secret(string, config.Secret) string {
-	return ""
+func (dryRunner) Secret(string, config.Secret) (string, error) {
+	return "", nil
 }
 
 func keys(m map[string]string) []string {
@@ -1,11 +1,18 @@
 package backup_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -17,6 +24,7 @@ import (
 	"github.com/mbrt/backsched/internal/backup"
 	"github.com/mbrt/backsched/internal/config"
 	"github.com/mbrt/backsched/internal/exec"
+	"github.com/mbrt/backsched/internal/store"
 )
 
 // testRunner is a fake exec.Runner.
@@ -34,13 +42,28 @@ func (t *testRunner) Run(ctx context.Context, cmd exec.Cmd) error {
 	if err := t.fs.MkdirAll("/run", 0o700); err != nil {
 		return err
 	}
-	data, err := json.MarshalIndent(cmd, "", "    ")
+	data, err := json.MarshalIndent(ranCmd{
+		Env:       cmd.Env,
+		Cmd:       cmd.Cmd,
+		Args:      cmd.Args,
+		Workdir:   cmd.Workdir,
+		SecretEnv: cmd.SecretEnv,
+	}, "", "    ")
 	if err != nil {
 		return err
 	}
 	return afero.WriteFile(t.fs, fmt.Sprintf("/run/%d", t.count), data, 0o600)
 }
 
+// ranCmd is the representation of the commands ran by testRunner.
+type ranCmd struct {
+	Env       map[string]string
+	Cmd       string
+	Args      []string
+	Workdir   string
+	SecretEnv map[string]string
+}
+
 type testSio struct {
 	fs afero.Fs
 }
@@ -55,8 +78,8 @@ func (t testSio) Load() ([]byte, error) {
 
 type testSecrets struct{}
 
-func (testSecrets) Secret(backup string, s config.Secret) string {
-	return fmt.Sprintf("%s-%s-val", backup, s.ID)
+func (testSecrets) Secret(backup string, s config.Secret) (string, error) {
+	return fmt.Sprintf("%s-%s-val", backup, s.ID), nil
 }
 
 func loadTestFile(t *testing.T, p string) []byte {
@@ -208,9 +231,9 @@ type faultySecrets struct {
 	t *testing.T
 }
 
-func (f faultySecrets) Secret(backup string, s config.Secret) string {
+func (f faultySecrets) Secret(backup string, s config.Secret) (string, error) {
 	f.t.Fatalf("Backup %s asked for secret %s, expected no call", backup, s.ID)
-	return ""
+	return "", nil
 }
 
 func TestSecrets(t *testing.T) {
@@ -264,3 +287,1231 @@ func TestSecrets(t *testing.T) {
 	})
 	assert.Nil(t, err)
 }
+
+type failingRunner struct {
+	err error
+}
+
+func (f failingRunner) Run(context.Context, exec.Cmd) error {
+	return f.err
+}
+
+func TestMetrics(t *testing.T) {
+	cfg, err := config.Parse("testfiles/complete.jsonnet")
+	require.Nil(t, err)
+	cfg.Metrics = &config.Metrics{Textfile: "/metrics/backsched.prom"}
+
+	// Set up fake environment.
+	ctx := context.Background()
+	clock := clockwork.NewFakeClockAt(time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC))
+	fs := afero.NewMemMapFs()
+	env := backup.Env{
+		Clock:   clock,
+		Fs:      fs,
+		Runner:  &testRunner{fs, 0},
+		Sio:     testSio{fs},
+		Secrets: testSecrets{},
+	}
+	opts := backup.Opts{AskSecrets: true}
+	err = fs.MkdirAll("/mnt/backup/dir2", 0x700)
+	require.Nil(t, err)
+	err = fs.MkdirAll("/metrics", 0x700)
+	require.Nil(t, err)
+
+	// Only hourly can run.
+	err = backup.Run(ctx, cfg, env, opts)
+	require.Nil(t, err)
+
+	// Make the next hourly run fail.
+	clock.Advance(2 * time.Hour)
+	env.Runner = failingRunner{errors.New("failed")}
+	err = backup.Run(ctx, cfg, env, opts)
+	require.NotNil(t, err)
+
+	expected := `# HELP backsched_last_success_timestamp_seconds Time of the last successful backup, zero if never.
+# TYPE backsched_last_success_timestamp_seconds gauge
+backsched_last_success_timestamp_seconds{backup="weekly"} 0
+backsched_last_success_timestamp_seconds{backup="hourly"} 1614592800
+# HELP backsched_last_duration_seconds Duration of the last backup run.
+# TYPE backsched_last_duration_seconds gauge
+backsched_last_duration_seconds{backup="hourly"} 0
+# HELP backsched_last_exit_status Exit status of the last backup run, -1 if it failed for other reasons.
+# TYPE backsched_last_exit_status gauge
+backsched_last_exit_status{backup="hourly"} -1
+# HELP backsched_interval_seconds Configured interval between backups.
+# TYPE backsched_interval_seconds gauge
+backsched_interval_seconds{backup="weekly"} 604800
+backsched_interval_seconds{backup="hourly"} 3600
+# HELP backsched_overdue Whether the last successful backup is older than the interval.
+# TYPE backsched_overdue gauge
+backsched_overdue{backup="weekly"} 1
+backsched_overdue{backup="hourly"} 1
+`
+	// Written automatically after the run.
+	checkFile(t, fs, "/metrics/backsched.prom", []byte(expected))
+
+	// Same output on demand.
+	var buf bytes.Buffer
+	err = backup.WriteMetrics(&buf, cfg, env)
+	require.Nil(t, err)
+	assert.Equal(t, expected, buf.String())
+}
+
+// outputRunner writes the command and its args to the command output, and
+// fails the commands called "false". The commands called "progress" write a
+// progress bar and a very long line too.
+type outputRunner struct{}
+
+func (outputRunner) Run(ctx context.Context, cmd exec.Cmd) error {
+	if cmd.Output != nil {
+		fmt.Fprintf(cmd.Output, "%s %v\n", cmd.Cmd, cmd.Args)
+		if cmd.Cmd == "progress" {
+			fmt.Fprintf(cmd.Output, "\r10%%\r20%%\r\n%s\n", strings.Repeat("x", 5000))
+		}
+	}
+	if cmd.Cmd == "false" {
+		return errors.New("command failed")
+	}
+	return nil
+}
+
+func TestHeartbeat(t *testing.T) {
+	type ping struct {
+		path string
+		body string
+	}
+	var (
+		mu    sync.Mutex
+		pings []ping
+	)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		pings = append(pings, ping{r.URL.Path, string(b)})
+	}))
+	defer hs.Close()
+
+	hb := func(name string) *config.Heartbeat {
+		return &config.Heartbeat{
+			Start:   hs.URL + "/" + name + "/start",
+			Success: hs.URL + "/" + name,
+			Fail:    hs.URL + "/" + name + "/fail",
+		}
+	}
+	cfg := config.Config{
+		Version: config.Version,
+		Backups: []config.Backup{
+			{
+				Name: "ok",
+				Commands: []config.Command{
+					{Cmd: "echo", Args: []string{"1"}},
+					{Cmd: "echo", Args: []string{"2"}},
+					{Cmd: "progress"},
+				},
+				Heartbeat: hb("ok"),
+			},
+			{
+				Name:     "no-heartbeat",
+				Commands: []config.Command{{Cmd: "echo"}},
+			},
+			{
+				Name:      "fail",
+				Commands:  []config.Command{{Cmd: "echo", Args: []string{"3"}}, {Cmd: "false"}},
+				Heartbeat: hb("fail"),
+			},
+		},
+	}
+	fs := afero.NewMemMapFs()
+	env := backup.Env{
+		Clock:  clockwork.NewFakeClock(),
+		Fs:     fs,
+		Runner: outputRunner{},
+		Sio:    testSio{fs},
+	}
+
+	err := backup.Run(context.Background(), cfg, env, backup.Opts{})
+	assert.NotNil(t, err)
+	assert.Equal(t, []ping{
+		{"/ok/start", ""},
+		{"/ok", "echo [1]\necho [2]\nprogress []\n10%\n20%\n" + strings.Repeat("x", 1024) + "\n"},
+		{"/fail/start", ""},
+		{"/fail/fail", "echo [3]\nfalse []\n\nbacksched: command failed\n"},
+	}, pings)
+
+	// Dry runs don't ping.
+	pings = nil
+	err = backup.Run(context.Background(), cfg, env, backup.Opts{DryRun: true})
+	assert.Nil(t, err)
+	assert.Empty(t, pings)
+}
+
+func TestVerify(t *testing.T) {
+	cfg := config.Config{
+		Version: config.Version,
+		Backups: []config.Backup{
+			{
+				Name:     "b",
+				Interval: config.Duration(7 * 24 * time.Hour),
+				Commands: []config.Command{{Cmd: "backup"}},
+				Verify: &config.Verify{
+					Interval: config.Duration(24 * time.Hour),
+					Commands: []config.Command{{Cmd: "restore", Env: map[string]string{"A": "B"}}},
+				},
+			},
+			{
+				Name:     "no-verify",
+				Interval: config.Duration(7 * 24 * time.Hour),
+				Commands: []config.Command{{Cmd: "backup"}},
+			},
+		},
+	}
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	fs := afero.NewMemMapFs()
+	runner := testRunner{fs, 0}
+	env := backup.Env{
+		Clock:  clock,
+		Fs:     fs,
+		Runner: &runner,
+		Sio:    testSio{fs},
+	}
+
+	// Backups run, followed by the verification.
+	err := backup.Run(ctx, cfg, env, backup.Opts{})
+	require.Nil(t, err)
+	assert.Equal(t, 3, runner.count)
+	b, err := afero.ReadFile(fs, "/run/3")
+	require.Nil(t, err)
+	var cmd ranCmd
+	require.Nil(t, json.Unmarshal(b, &cmd))
+	assert.Equal(t, "restore", cmd.Cmd)
+	assert.Equal(t, "B", cmd.Env["A"])
+	// The temporary directory was removed.
+	dir := cmd.Env[config.VerifyDirEnv]
+	assert.NotEmpty(t, dir)
+	ok, _ := afero.Exists(fs, dir)
+	assert.False(t, ok)
+
+	vi, err := backup.ComputeVerifyIssues(ctx, cfg, env)
+	require.Nil(t, err)
+	assert.Empty(t, vi)
+	st, err := backup.ComputeStatus(ctx, cfg, env, false)
+	require.Nil(t, err)
+	assert.False(t, st[0].Verify.Due)
+	assert.Nil(t, st[1].Verify)
+
+	// After a day the verification is due, but not the backup.
+	clock.Advance(25 * time.Hour)
+	vi, err = backup.ComputeVerifyIssues(ctx, cfg, env)
+	require.Nil(t, err)
+	require.Len(t, vi, 1)
+	assert.Equal(t, "b: last verified 25h ago", vi[0].String())
+
+	// A failing verification is reported.
+	env.Runner = failingRunner{errors.New("mismatch")}
+	err = backup.Verify(ctx, cfg, env, backup.Opts{}, nil)
+	assert.NotNil(t, err)
+	vi, err = backup.ComputeVerifyIssues(ctx, cfg, env)
+	require.Nil(t, err)
+	require.Len(t, vi, 1)
+	assert.Equal(t, "b: last verification failed: mismatch", vi[0].String())
+
+	// Explicit verification.
+	env.Runner = &runner
+	err = backup.Verify(ctx, cfg, env, backup.Opts{}, []string{"b"})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, runner.count)
+	vi, err = backup.ComputeVerifyIssues(ctx, cfg, env)
+	require.Nil(t, err)
+	assert.Empty(t, vi)
+
+	// Dry runs don't create the temporary directory.
+	denv := env
+	denv.Fs = afero.NewReadOnlyFs(fs)
+	err = backup.Verify(ctx, cfg, denv, backup.Opts{DryRun: true}, []string{"b"})
+	assert.Nil(t, err)
+
+	err = backup.Verify(ctx, cfg, env, backup.Opts{}, []string{"no-verify"})
+	assert.NotNil(t, err)
+	err = backup.Verify(ctx, cfg, env, backup.Opts{}, []string{"unknown"})
+	assert.NotNil(t, err)
+}
+
+// stdoutRunner prints the given output on the command stdout.
+type stdoutRunner struct {
+	out string
+}
+
+func (s stdoutRunner) Run(ctx context.Context, cmd exec.Cmd) error {
+	if cmd.Stdout != nil {
+		_, err := io.WriteString(cmd.Stdout, s.out)
+		return err
+	}
+	return nil
+}
+
+func TestFreshness(t *testing.T) {
+	now := time.Date(2021, 3, 10, 10, 0, 0, 0, time.UTC)
+	hoursAgo := func(h int) time.Time {
+		return now.Add(-time.Duration(h) * time.Hour)
+	}
+	str := func(s string) *string { return &s }
+	newBackup := func(name string, f config.Freshness) config.Backup {
+		return config.Backup{
+			Name:      name,
+			Interval:  config.Duration(24 * time.Hour),
+			Commands:  []config.Command{{Cmd: "echo"}},
+			Freshness: &f,
+		}
+	}
+
+	cfg := config.Config{
+		Version: config.Version,
+		Backups: []config.Backup{
+			newBackup("marker", config.Freshness{Marker: str("/dest/marker")}),
+			newBackup("marker-missing", config.Freshness{Marker: str("/dest/nope")}),
+			newBackup("newest", config.Freshness{Newest: str("/dest/tree")}),
+			newBackup("command", config.Freshness{Command: &config.ProbeCommand{Cmd: "last-snapshot"}}),
+			newBackup("override", config.Freshness{Marker: str("/dest/old-marker"), Override: true}),
+		},
+	}
+	fs := afero.NewMemMapFs()
+	touch := func(p string, mtime time.Time) {
+		require.Nil(t, afero.WriteFile(fs, p, nil, 0o600))
+		require.Nil(t, fs.Chtimes(p, mtime, mtime))
+	}
+	require.Nil(t, fs.MkdirAll("/dest/tree/sub", 0o700))
+	touch("/dest/marker", hoursAgo(2))
+	touch("/dest/tree/a", hoursAgo(50))
+	touch("/dest/tree/sub/b", hoursAgo(3))
+	touch("/dest/old-marker", hoursAgo(30))
+
+	// The local state knows only about the override backup, done recently.
+	state := config.State{}
+	state.RecordRun("override", config.RunInfo{Start: hoursAgo(1)})
+	buf, err := state.Save()
+	require.Nil(t, err)
+	sio := testSio{fs}
+	require.Nil(t, sio.Save(buf))
+
+	env := backup.Env{
+		Clock:  clockwork.NewFakeClockAt(now),
+		Fs:     fs,
+		Runner: stdoutRunner{fmt.Sprintf("%d\n", hoursAgo(4).Unix())},
+		Sio:    sio,
+	}
+	st, err := backup.ComputeStatus(context.Background(), cfg, env, false)
+	require.Nil(t, err)
+	lastSuccess := map[string]*time.Time{}
+	for _, s := range st {
+		lastSuccess[s.Name] = s.LastSuccess
+	}
+	assert.Equal(t, hoursAgo(2), lastSuccess["marker"].UTC())
+	assert.Nil(t, lastSuccess["marker-missing"])
+	assert.Equal(t, hoursAgo(3), lastSuccess["newest"].UTC())
+	assert.Equal(t, hoursAgo(4), lastSuccess["command"].UTC())
+	assert.Equal(t, hoursAgo(30), lastSuccess["override"].UTC())
+
+	od, err := backup.ComputeOutdated(context.Background(), cfg, env)
+	require.Nil(t, err)
+	var names []string
+	for _, i := range od {
+		names = append(names, i.Backup.Name)
+	}
+	assert.Equal(t, []string{"marker-missing", "override"}, names)
+}
+
+// sideRunner runs a function before every command.
+type sideRunner struct {
+	f func()
+}
+
+func (r sideRunner) Run(ctx context.Context, cmd exec.Cmd) error {
+	r.f()
+	return nil
+}
+
+func TestSharedState(t *testing.T) {
+	cfg, err := config.Parse("testfiles/complete.jsonnet")
+	require.Nil(t, err)
+
+	// Set up fake environment.
+	ctx := context.Background()
+	clock := clockwork.NewFakeClockAt(time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC))
+	fs := afero.NewMemMapFs()
+	sio := store.File{Fs: fs, Clock: clock, Path: "/nas/state.json", Owner: "host1"}
+	sio2 := store.File{Fs: fs, Clock: clock, Path: "/nas/state.json", Owner: "host2"}
+	other := time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)
+	locked := false
+	env := backup.Env{
+		Clock: clock,
+		Fs:    fs,
+		Runner: sideRunner{func() {
+			// Other machines can't lock the state during the run.
+			canceled, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err := sio2.Lock(canceled)
+			locked = err != nil
+			// Somebody updates the state anyway, e.g. after breaking the
+			// lock.
+			s := config.State{"weekly": {LastSuccess: other}}
+			buf, _ := s.Save()
+			_ = afero.WriteFile(fs, "/nas/state.json", buf, 0o600)
+		}},
+		Sio:     sio,
+		Secrets: testSecrets{},
+	}
+	err = fs.MkdirAll("/mnt/backup/dir2", 0x700)
+	require.Nil(t, err)
+
+	err = backup.Run(ctx, cfg, env, backup.Opts{})
+	require.Nil(t, err)
+	assert.True(t, locked)
+
+	// Both updates are kept.
+	buf, err := sio.Load()
+	require.Nil(t, err)
+	state, err := config.LoadState(buf)
+	require.Nil(t, err)
+	last, ok := state.LastBackupOf("hourly")
+	assert.True(t, ok)
+	assert.Equal(t, clock.Now(), last)
+	last, ok = state.LastBackupOf("weekly")
+	assert.True(t, ok)
+	assert.Equal(t, other, last)
+
+	// The lock is released.
+	_, err = fs.Stat("/nas/state.json.lock")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestHosts(t *testing.T) {
+	cfg, err := config.Parse("testfiles/complete.jsonnet")
+	require.Nil(t, err)
+	// Only meant for the server.
+	cfg.Backups[0].Hosts = []string{"server"}
+	cfg.Backups[1].Platforms = []string{"linux"}
+
+	// Set up fake environment.
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	fs := afero.NewMemMapFs()
+	runner := testRunner{fs, 0}
+	env := backup.Env{
+		Clock:   clock,
+		Fs:      fs,
+		Runner:  &runner,
+		Sio:     testSio{fs},
+		Secrets: testSecrets{},
+		Host:    config.Host{Name: "laptop", OS: "linux", Arch: "amd64"},
+	}
+	err = fs.MkdirAll("/mnt/backup/dir1", 0x700)
+	require.Nil(t, err)
+	err = fs.MkdirAll("/mnt/backup/dir2", 0x700)
+	require.Nil(t, err)
+
+	infos, err := backup.ComputeOutdated(ctx, cfg, env)
+	require.Nil(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "hourly", infos[0].Backup.Name)
+
+	// Only hourly runs.
+	err = backup.Run(ctx, cfg, env, backup.Opts{})
+	require.Nil(t, err)
+	assert.Equal(t, 2, runner.count)
+
+	st, err := backup.ComputeStatus(ctx, cfg, env, false)
+	require.Nil(t, err)
+	require.Len(t, st, 1)
+	assert.Equal(t, "hourly", st[0].Name)
+
+	// The other backups are still listed on demand.
+	st, err = backup.ComputeStatus(ctx, cfg, env, true)
+	require.Nil(t, err)
+	require.Len(t, st, 2)
+	assert.Equal(t, "weekly", st[0].Name)
+	assert.True(t, st[0].OtherHost)
+	assert.True(t, st[0].Outdated)
+	assert.False(t, st[1].OtherHost)
+	assert.False(t, st[1].Outdated)
+}
+
+func TestEditState(t *testing.T) {
+	cfg, err := config.Parse("testfiles/complete.jsonnet")
+	require.Nil(t, err)
+
+	ctx := context.Background()
+	clock := clockwork.NewFakeClockAt(time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC))
+	fs := afero.NewMemMapFs()
+	env := backup.Env{
+		Clock: clock,
+		Fs:    fs,
+		Sio:   testSio{fs},
+	}
+	lastOf := func(name string) (time.Time, bool) {
+		buf, err := afero.ReadFile(fs, "/state")
+		require.Nil(t, err)
+		state, err := config.LoadState(buf)
+		require.Nil(t, err)
+		return state.LastBackupOf(name)
+	}
+
+	// Marking works without a previous state.
+	err = backup.Mark(ctx, cfg, env, "hourly", clock.Now())
+	require.Nil(t, err)
+	infos, err := backup.ComputeOutdated(ctx, cfg, env)
+	require.Nil(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "weekly", infos[0].Backup.Name)
+	assert.Error(t, backup.Mark(ctx, cfg, env, "unknown", clock.Now()))
+
+	err = backup.Reset(ctx, cfg, env, []string{"hourly"})
+	require.Nil(t, err)
+	_, ok := lastOf("hourly")
+	assert.False(t, ok)
+
+	// Rename an entry left by an old config.
+	state := config.State{}
+	state.MarkSuccess("old", clock.Now(), clock.Now())
+	state.MarkSuccess("older", clock.Now(), clock.Now())
+	buf, err := state.Save()
+	require.Nil(t, err)
+	require.Nil(t, afero.WriteFile(fs, "/state", buf, 0o600))
+	err = backup.Rename(ctx, cfg, env, "old", "weekly")
+	require.Nil(t, err)
+	last, ok := lastOf("weekly")
+	assert.True(t, ok)
+	assert.Equal(t, clock.Now(), last)
+
+	removed, err := backup.Prune(ctx, cfg, env)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"older"}, removed)
+
+	// A corrupted state is never overwritten.
+	require.Nil(t, afero.WriteFile(fs, "/state", []byte("{"), 0o600))
+	assert.Error(t, backup.Reset(ctx, cfg, env, []string{"hourly"}))
+	checkFile(t, fs, "/state", []byte("{"))
+}
+
+// eventLog records secret requests and command runs, in order.
+type eventLog struct {
+	events []string
+}
+
+func (l *eventLog) Secret(backup string, s config.Secret) (string, error) {
+	l.events = append(l.events, fmt.Sprintf("secret %s/%s", backup, s.ID))
+	return "val", nil
+}
+
+func (l *eventLog) Run(ctx context.Context, cmd exec.Cmd) error {
+	l.events = append(l.events, fmt.Sprintf("run %s %v", cmd.Cmd, cmd.Args))
+	return nil
+}
+
+func TestSecretsUpFront(t *testing.T) {
+	cfg, err := config.Parse("testfiles/complete.jsonnet")
+	require.Nil(t, err)
+	// Both backups share a global secret.
+	for i := range cfg.Backups {
+		cfg.Backups[i].Commands[0].SecretEnv = map[string]config.Secret{
+			"PASS": {ID: "repo", Global: true},
+		}
+	}
+	// The verification needs a secret too.
+	cfg.Backups[1].Verify = &config.Verify{
+		Interval: config.Duration(time.Hour),
+		Commands: []config.Command{{
+			Cmd:       "restore",
+			SecretEnv: map[string]config.Secret{"KEY": {ID: "key"}},
+		}},
+	}
+
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	events := &eventLog{}
+	env := backup.Env{
+		Clock:   clockwork.NewFakeClock(),
+		Fs:      fs,
+		Runner:  events,
+		Sio:     testSio{fs},
+		Secrets: events,
+	}
+	err = fs.MkdirAll("/mnt/backup/dir1", 0x700)
+	require.Nil(t, err)
+	err = fs.MkdirAll("/mnt/backup/dir2", 0x700)
+	require.Nil(t, err)
+
+	err = backup.Run(ctx, cfg, env, backup.Opts{AskSecrets: true})
+	require.Nil(t, err)
+	assert.Equal(t, []string{
+		"secret /repo",
+		"secret weekly/secret2",
+		"secret hourly/secret2",
+		"secret hourly/key",
+		"run echo [start weekly]",
+		"run echo [stop weekly]",
+		"run echo [start hourly]",
+		"run echo [stop hourly]",
+		"run restore []",
+	}, events.events)
+}
+
+func TestAskSecrets(t *testing.T) {
+	cfg, err := config.Parse("testfiles/complete.jsonnet")
+	require.Nil(t, err)
+	cfg.Backups[0].Commands[0].SecretEnv = map[string]config.Secret{
+		"PASS": {ID: "repo", Global: true},
+	}
+	env := backup.Env{Secrets: testSecrets{}}
+
+	vals, err := backup.AskSecrets(context.Background(), cfg, env)
+	require.Nil(t, err)
+	assert.Equal(t, []backup.SecretValue{
+		{ID: "repo", Value: "-repo-val"},
+		{Backup: "hourly", ID: "secret2", Value: "hourly-secret2-val"},
+		{Backup: "weekly", ID: "secret2", Value: "weekly-secret2-val"},
+	}, vals)
+
+	env.Secrets = canceledSecrets{}
+	_, err = backup.AskSecrets(context.Background(), cfg, env)
+	assert.ErrorIs(t, err, errCanceled)
+}
+
+var errCanceled = errors.New("canceled by the user")
+
+// canceledSecrets fails every request, as if the user canceled the prompt.
+type canceledSecrets struct{}
+
+func (canceledSecrets) Secret(string, config.Secret) (string, error) {
+	return "", errCanceled
+}
+
+func TestSecretsCanceled(t *testing.T) {
+	cfg, err := config.Parse("testfiles/complete.jsonnet")
+	require.Nil(t, err)
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	runner := &captureRunner{}
+	env := backup.Env{
+		Clock:   clockwork.NewFakeClock(),
+		Fs:      fs,
+		Runner:  runner,
+		Sio:     testSio{fs},
+		Secrets: canceledSecrets{},
+	}
+	require.Nil(t, fs.MkdirAll("/mnt/backup/dir1", 0x700))
+	require.Nil(t, fs.MkdirAll("/mnt/backup/dir2", 0x700))
+
+	// Nothing runs.
+	err = backup.Run(ctx, cfg, env, backup.Opts{AskSecrets: true})
+	assert.ErrorIs(t, err, errCanceled)
+	assert.Empty(t, runner.cmds)
+}
+
+// interruptingSecrets cancels the run at the first request, as a signal
+// received while the user is prompted would.
+type interruptingSecrets struct {
+	cancel func()
+	asked  *int
+}
+
+func (s interruptingSecrets) Secret(string, config.Secret) (string, error) {
+	*s.asked++
+	s.cancel()
+	return "val", nil
+}
+
+func TestSecretsInterrupted(t *testing.T) {
+	cfg, err := config.Parse("testfiles/complete.jsonnet")
+	require.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fs := afero.NewMemMapFs()
+	runner := &captureRunner{}
+	asked := 0
+	env := backup.Env{
+		Clock:   clockwork.NewFakeClock(),
+		Fs:      fs,
+		Runner:  runner,
+		Sio:     testSio{fs},
+		Secrets: interruptingSecrets{cancel, &asked},
+	}
+	require.Nil(t, fs.MkdirAll("/mnt/backup/dir1", 0x700))
+	require.Nil(t, fs.MkdirAll("/mnt/backup/dir2", 0x700))
+
+	// The remaining secrets are not asked.
+	err = backup.Run(ctx, cfg, env, backup.Opts{AskSecrets: true})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, asked)
+	assert.Empty(t, runner.cmds)
+}
+
+// captureRunner records the commands it runs.
+type captureRunner struct {
+	cmds []exec.Cmd
+}
+
+func (c *captureRunner) Run(ctx context.Context, cmd exec.Cmd) error {
+	c.cmds = append(c.cmds, cmd)
+	return nil
+}
+
+func TestSecretDelivery(t *testing.T) {
+	cfg := config.Config{
+		Version: config.Version,
+		Backups: []config.Backup{{
+			Name:     "b1",
+			Interval: config.Duration(time.Hour),
+			Commands: []config.Command{{
+				Cmd:         "restic",
+				Args:        []string{"--password-file=${PASS}", "backup"},
+				SecretFiles: map[string]config.Secret{"PASS": {ID: "repo"}},
+				SecretStdin: &config.Secret{ID: "key"},
+			}},
+		}},
+	}
+	fs := afero.NewMemMapFs()
+	runner := &captureRunner{}
+	env := backup.Env{
+		Clock:   clockwork.NewFakeClock(),
+		Fs:      fs,
+		Runner:  runner,
+		Sio:     testSio{fs},
+		Secrets: testSecrets{},
+	}
+
+	err := backup.Run(context.Background(), cfg, env, backup.Opts{AskSecrets: true})
+	require.Nil(t, err)
+	require.Len(t, runner.cmds, 1)
+	cmd := runner.cmds[0]
+	assert.Empty(t, cmd.SecretEnv)
+	assert.Equal(t, map[string]string{"PASS": "b1-repo-val"}, cmd.SecretFiles)
+	require.NotNil(t, cmd.SecretStdin)
+	assert.Equal(t, "b1-key-val", *cmd.SecretStdin)
+}
+
+// sequenceSecrets returns the given values in order, one per request.
+type sequenceSecrets struct {
+	vals []string
+}
+
+func (s *sequenceSecrets) Secret(string, config.Secret) (string, error) {
+	v := s.vals[0]
+	s.vals = s.vals[1:]
+	return v, nil
+}
+
+// validatingRunner fails the "check" commands, unless the secret is "good".
+type validatingRunner struct {
+	captureRunner
+}
+
+func (r *validatingRunner) Run(ctx context.Context, cmd exec.Cmd) error {
+	if cmd.Cmd == "check" {
+		if cmd.SecretFiles[config.SecretFileEnv] != "good" {
+			return errors.New("wrong password")
+		}
+		return nil
+	}
+	return r.captureRunner.Run(ctx, cmd)
+}
+
+func TestSecretValidation(t *testing.T) {
+	backupWith := func(name, id string) config.Backup {
+		return config.Backup{
+			Name:     name,
+			Interval: config.Duration(time.Hour),
+			Commands: []config.Command{{
+				Cmd: "restic",
+				SecretEnv: map[string]config.Secret{"PASS": {
+					ID:       id,
+					Validate: &config.SecretValidation{Cmd: "check", Attempts: 2},
+				}},
+			}},
+		}
+	}
+	cfg := config.Config{
+		Version: config.Version,
+		Backups: []config.Backup{backupWith("b1", "repo"), backupWith("b2", "repo")},
+	}
+	fs := afero.NewMemMapFs()
+	runner := &validatingRunner{}
+	// The first backup succeeds at the second attempt, the second one fails
+	// all of them.
+	secrets := &sequenceSecrets{vals: []string{"typo", "good", "typo", "typo"}}
+	env := backup.Env{
+		Clock:   clockwork.NewFakeClock(),
+		Fs:      fs,
+		Runner:  runner,
+		Sio:     testSio{fs},
+		Secrets: secrets,
+	}
+
+	err := backup.Run(context.Background(), cfg, env, backup.Opts{AskSecrets: true})
+	require.Nil(t, err)
+	assert.Empty(t, secrets.vals)
+	require.Len(t, runner.cmds, 1)
+	assert.Equal(t, map[string]string{"PASS": "good"}, runner.cmds[0].SecretEnv)
+
+	// The second backup was skipped.
+	infos, err := backup.ComputeOutdated(context.Background(), cfg, env)
+	require.Nil(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "b2", infos[0].Backup.Name)
+}
+
+// cachingSecrets returns the cached values when present, like the agent does,
+// and asks the fallback otherwise.
+type cachingSecrets struct {
+	cache       map[string]string
+	fallback    sequenceSecrets
+	invalidated []string
+}
+
+func (c *cachingSecrets) Secret(b string, s config.Secret) (string, error) {
+	if v, ok := c.cache[s.ID]; ok {
+		return v, nil
+	}
+	return c.fallback.Secret(b, s)
+}
+
+func (c *cachingSecrets) Invalidate(_ string, s config.Secret) {
+	c.invalidated = append(c.invalidated, s.ID)
+	delete(c.cache, s.ID)
+}
+
+func TestSecretValidationInvalidate(t *testing.T) {
+	cfg := config.Config{
+		Version: config.Version,
+		Backups: []config.Backup{{
+			Name:     "b1",
+			Interval: config.Duration(time.Hour),
+			Commands: []config.Command{{
+				Cmd: "restic",
+				SecretEnv: map[string]config.Secret{"PASS": {
+					ID:       "repo",
+					Validate: &config.SecretValidation{Cmd: "check", Attempts: 2},
+				}},
+			}},
+		}},
+	}
+	fs := afero.NewMemMapFs()
+	runner := &validatingRunner{}
+	// The cached value is wrong: the retry must not get it again.
+	secrets := &cachingSecrets{
+		cache:    map[string]string{"repo": "typo"},
+		fallback: sequenceSecrets{vals: []string{"good"}},
+	}
+	env := backup.Env{
+		Clock:   clockwork.NewFakeClock(),
+		Fs:      fs,
+		Runner:  runner,
+		Sio:     testSio{fs},
+		Secrets: secrets,
+	}
+
+	err := backup.Run(context.Background(), cfg, env, backup.Opts{AskSecrets: true})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"repo"}, secrets.invalidated)
+	assert.Empty(t, secrets.fallback.vals)
+	require.Len(t, runner.cmds, 1)
+	assert.Equal(t, map[string]string{"PASS": "good"}, runner.cmds[0].SecretEnv)
+}
+
+// cancelingRunner cancels the run while validating a secret.
+type cancelingRunner struct {
+	captureRunner
+	cancel func()
+}
+
+func (r *cancelingRunner) Run(ctx context.Context, cmd exec.Cmd) error {
+	if cmd.Cmd == "check" {
+		r.cancel()
+		return errors.New("signal: terminated")
+	}
+	return r.captureRunner.Run(ctx, cmd)
+}
+
+func TestSecretValidationCanceled(t *testing.T) {
+	cfg := config.Config{
+		Version: config.Version,
+		Backups: []config.Backup{{
+			Name:     "b1",
+			Interval: config.Duration(time.Hour),
+			Commands: []config.Command{{
+				Cmd: "restic",
+				SecretEnv: map[string]config.Secret{"PASS": {
+					ID:       "repo",
+					Validate: &config.SecretValidation{Cmd: "check", Attempts: 3},
+				}},
+			}},
+		}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fs := afero.NewMemMapFs()
+	runner := &cancelingRunner{cancel: cancel}
+	secrets := &cachingSecrets{
+		cache:    map[string]string{"repo": "good"},
+		fallback: sequenceSecrets{vals: []string{"other"}},
+	}
+	env := backup.Env{
+		Clock:   clockwork.NewFakeClock(),
+		Fs:      fs,
+		Runner:  runner,
+		Sio:     testSio{fs},
+		Secrets: secrets,
+	}
+
+	// The secret is neither invalidated nor asked again.
+	err := backup.Run(ctx, cfg, env, backup.Opts{AskSecrets: true})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, secrets.invalidated)
+	assert.Len(t, secrets.fallback.vals, 1)
+	assert.Empty(t, runner.cmds)
+}
+
+func TestPlan(t *testing.T) {
+	cfg, err := config.Parse("testfiles/complete.jsonnet")
+	require.Nil(t, err)
+
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	fs := afero.NewMemMapFs()
+	runner := testRunner{fs, 0}
+	env := backup.Env{
+		Clock:   clock,
+		Fs:      fs,
+		Runner:  &runner,
+		Sio:     testSio{fs},
+		Secrets: testSecrets{},
+	}
+	require.Nil(t, fs.MkdirAll("/mnt/backup/dir2", 0o700))
+	// Hourly ran 30 minutes ago.
+	state := config.State{}
+	state.MarkSuccess("hourly", clock.Now().Add(-30*time.Minute), clock.Now())
+	buf, err := state.Save()
+	require.Nil(t, err)
+	require.Nil(t, env.Sio.Save(buf))
+
+	plan, err := backup.ComputePlan(ctx, cfg, env, backup.Opts{})
+	require.Nil(t, err)
+	require.Len(t, plan.Backups, 2)
+
+	weekly := plan.Backups[0]
+	assert.Equal(t, "weekly", weekly.Name)
+	assert.True(t, weekly.Due)
+	assert.False(t, weekly.Run)
+	assert.Contains(t, weekly.Reason, "never backed up, but")
+	require.Len(t, weekly.Requirements, 2)
+	assert.False(t, weekly.Requirements[0].OK)
+	assert.NotEmpty(t, weekly.Requirements[0].Error)
+	assert.True(t, weekly.Requirements[1].OK)
+
+	hourly := plan.Backups[1]
+	assert.Equal(t, "hourly", hourly.Name)
+	assert.False(t, hourly.Due)
+	assert.False(t, hourly.Run)
+	assert.Equal(t, "last backup was 30m ago, interval is 1h", hourly.Reason)
+	require.NotNil(t, hourly.LastSuccess)
+
+	// Commands are resolved, with secrets masked.
+	assert.Equal(t, []backup.PlannedCommand{
+		{
+			Cmd:     "echo",
+			Args:    []string{"start", "hourly"},
+			Workdir: "/home",
+			Env:     map[string]string{"env1": "val1"},
+		},
+		{
+			Cmd:       "echo",
+			Args:      []string{"stop", "hourly"},
+			SecretEnv: map[string]string{"env2": "<secret:secret2>"},
+		},
+	}, hourly.Commands)
+
+	// Nothing ran and no secret was asked.
+	ok, _ := afero.Exists(fs, "/run/1")
+	assert.False(t, ok)
+	js, err := json.Marshal(plan)
+	require.Nil(t, err)
+	assert.NotContains(t, string(js), "-val")
+}
+
+func TestPlanFreshnessCommand(t *testing.T) {
+	cfg := config.Config{
+		Version: config.Version,
+		Backups: []config.Backup{{
+			Name:      "b1",
+			Interval:  config.Duration(time.Hour),
+			Commands:  []config.Command{{Cmd: "restic"}},
+			Freshness: &config.Freshness{Command: &config.ProbeCommand{Cmd: "last-snapshot"}},
+		}},
+	}
+	clock := clockwork.NewFakeClock()
+	fs := afero.NewMemMapFs()
+	runner := &captureRunner{}
+	env := backup.Env{
+		Clock:   clock,
+		Fs:      fs,
+		Runner:  runner,
+		Sio:     testSio{fs},
+		Secrets: testSecrets{},
+	}
+	state := config.State{}
+	state.MarkSuccess("b1", clock.Now().Add(-30*time.Minute), clock.Now())
+	buf, err := state.Save()
+	require.Nil(t, err)
+	require.Nil(t, env.Sio.Save(buf))
+
+	// The probe doesn't run: only the local state is used.
+	plan, err := backup.ComputePlan(context.Background(), cfg, env, backup.Opts{})
+	require.Nil(t, err)
+	assert.Empty(t, runner.cmds)
+	require.Len(t, plan.Backups, 1)
+	assert.Equal(t, "unknown (probe not run)", plan.Backups[0].Freshness)
+	assert.False(t, plan.Backups[0].Due)
+	require.NotNil(t, plan.Backups[0].LastSuccess)
+}
+
+// flakyRunner records the commands it runs and fails the given one.
+type flakyRunner struct {
+	fail string
+	cmds []string
+}
+
+func (r *flakyRunner) Run(ctx context.Context, cmd exec.Cmd) error {
+	r.cmds = append(r.cmds, cmd.Cmd)
+	if cmd.Cmd == r.fail {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func TestResume(t *testing.T) {
+	cfg := config.Config{
+		Version: config.Version,
+		Backups: []config.Backup{{
+			Name:     "b1",
+			Interval: config.Duration(time.Hour),
+			Commands: []config.Command{
+				{Cmd: "rsync"}, {Cmd: "restic"}, {Cmd: "prune"},
+			},
+		}},
+	}
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	runner := &flakyRunner{fail: "prune"}
+	env := backup.Env{
+		Clock:   clockwork.NewFakeClock(),
+		Fs:      fs,
+		Runner:  runner,
+		Sio:     testSio{fs},
+		Secrets: testSecrets{},
+	}
+
+	// The first run fails in the last command.
+	err := backup.Run(ctx, cfg, env, backup.Opts{})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"rsync", "restic", "prune"}, runner.cmds)
+
+	// Without resuming, the run starts over.
+	runner.cmds = nil
+	err = backup.Run(ctx, cfg, env, backup.Opts{})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"rsync", "restic", "prune"}, runner.cmds)
+
+	// Resuming continues from the failed command.
+	runner.cmds = nil
+	runner.fail = ""
+	err = backup.Run(ctx, cfg, env, backup.Opts{Resume: true})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"prune"}, runner.cmds)
+
+	// The checkpoint is gone after a success.
+	buf, err := afero.ReadFile(fs, "/state")
+	require.Nil(t, err)
+	state, err := config.LoadState(buf)
+	require.Nil(t, err)
+	assert.Nil(t, state["b1"].Checkpoint)
+
+	// Resumable backups resume by default, unless the commands changed.
+	cfg.Backups[0].Resumable = true
+	env.Clock.(clockwork.FakeClock).Advance(2 * time.Hour)
+	runner.cmds = nil
+	runner.fail = "restic"
+	assert.Error(t, backup.Run(ctx, cfg, env, backup.Opts{}))
+	runner.cmds = nil
+	runner.fail = ""
+	require.Nil(t, backup.Run(ctx, cfg, env, backup.Opts{}))
+	assert.Equal(t, []string{"restic", "prune"}, runner.cmds)
+
+	env.Clock.(clockwork.FakeClock).Advance(2 * time.Hour)
+	runner.cmds = nil
+	runner.fail = "restic"
+	assert.Error(t, backup.Run(ctx, cfg, env, backup.Opts{}))
+	cfg.Backups[0].Commands[2].Args = []string{"--keep-last", "3"}
+	runner.cmds = nil
+	runner.fail = ""
+	require.Nil(t, backup.Run(ctx, cfg, env, backup.Opts{}))
+	assert.Equal(t, []string{"rsync", "restic", "prune"}, runner.cmds)
+}
+
+func TestResumeStale(t *testing.T) {
+	cfg := config.Config{
+		Version: config.Version,
+		Backups: []config.Backup{{
+			Name:      "b1",
+			Interval:  config.Duration(time.Hour),
+			Resumable: true,
+			Commands: []config.Command{
+				{Cmd: "rsync"}, {Cmd: "restic"}, {Cmd: "prune"},
+			},
+		}},
+	}
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	clock := clockwork.NewFakeClock()
+	runner := &flakyRunner{fail: "prune"}
+	env := backup.Env{
+		Clock:   clock,
+		Fs:      fs,
+		Runner:  runner,
+		Sio:     testSio{fs},
+		Secrets: testSecrets{},
+	}
+	assert.Error(t, backup.Run(ctx, cfg, env, backup.Opts{}))
+
+	// The checkpoint is older than the interval: the run starts over.
+	clock.Advance(time.Hour)
+	plan, err := backup.ComputePlan(ctx, cfg, env, backup.Opts{})
+	require.Nil(t, err)
+	require.Len(t, plan.Backups, 1)
+	assert.Zero(t, plan.Backups[0].ResumeFrom)
+	runner.cmds = nil
+	assert.Error(t, backup.Run(ctx, cfg, env, backup.Opts{}))
+	assert.Equal(t, []string{"rsync", "restic", "prune"}, runner.cmds)
+
+	// Unless resuming explicitly.
+	clock.Advance(time.Hour)
+	plan, err = backup.ComputePlan(ctx, cfg, env, backup.Opts{Resume: true})
+	require.Nil(t, err)
+	assert.Equal(t, 2, plan.Backups[0].ResumeFrom)
+	runner.cmds = nil
+	runner.fail = ""
+	require.Nil(t, backup.Run(ctx, cfg, env, backup.Opts{Resume: true}))
+	assert.Equal(t, []string{"prune"}, runner.cmds)
+}
+
+// cancelRunner cancels the run when the given command starts.
+type cancelRunner struct {
+	cancel func()
+	at     string
+	cmds   []string
+}
+
+func (r *cancelRunner) Run(ctx context.Context, cmd exec.Cmd) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.cmds = append(r.cmds, cmd.Cmd)
+	if cmd.Cmd == r.at {
+		r.cancel()
+		return errors.New("signal: terminated")
+	}
+	return nil
+}
+
+func TestInterrupted(t *testing.T) {
+	cmds := []config.Command{{Cmd: "rsync"}, {Cmd: "restic"}}
+	cfg := config.Config{
+		Version: config.Version,
+		Backups: []config.Backup{
+			{Name: "b1", Interval: config.Duration(time.Hour), Commands: cmds},
+			{Name: "b2", Interval: config.Duration(time.Hour), Commands: cmds},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fs := afero.NewMemMapFs()
+	runner := &cancelRunner{cancel: cancel, at: "restic"}
+	env := backup.Env{
+		Clock:   clockwork.NewFakeClock(),
+		Fs:      fs,
+		Runner:  runner,
+		Sio:     testSio{fs},
+		Secrets: testSecrets{},
+	}
+
+	err := backup.Run(ctx, cfg, env, backup.Opts{})
+	assert.Error(t, err)
+	// The second backup didn't start.
+	assert.Equal(t, []string{"rsync", "restic"}, runner.cmds)
+
+	buf, err := afero.ReadFile(fs, "/state")
+	require.Nil(t, err)
+	state, err := config.LoadState(buf)
+	require.Nil(t, err)
+	lr := state["b1"].LastRun()
+	require.NotNil(t, lr)
+	assert.True(t, lr.Interrupted)
+	assert.Equal(t, 1, state["b1"].Checkpoint.Completed)
+	assert.Nil(t, state["b2"].LastRun())
+
+	od, err := backup.ComputeOutdated(context.Background(), cfg, env)
+	require.Nil(t, err)
+	require.Len(t, od, 2)
+	assert.True(t, od[0].Interrupted)
+	assert.Equal(t, "b1: last backup was never? (last run was interrupted)", od[0].String())
+	assert.False(t, od[1].Interrupted)
+}
+
+// unplugRunner removes the given directory while the command runs, and
+// blocks until the run is aborted.
+type unplugRunner struct {
+	fs    afero.Fs
+	clock clockwork.FakeClock
+	dir   string
+}
+
+func (r unplugRunner) Run(ctx context.Context, cmd exec.Cmd) error {
+	if err := r.fs.RemoveAll(r.dir); err != nil {
+		return err
+	}
+	r.clock.BlockUntil(1)
+	r.clock.Advance(time.Minute)
+	<-ctx.Done()
+	return errors.New("signal: terminated")
+}
+
+func TestRequirementLost(t *testing.T) {
+	cfg, err := config.Parse("testfiles/complete.jsonnet")
+	require.Nil(t, err)
+
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	fs := afero.NewMemMapFs()
+	env := backup.Env{
+		Clock:   clock,
+		Fs:      fs,
+		Runner:  unplugRunner{fs, clock, "/mnt/backup/dir2"},
+		Sio:     testSio{fs},
+		Secrets: testSecrets{},
+	}
+	require.Nil(t, fs.MkdirAll("/mnt/backup/dir2", 0o700))
+
+	err = backup.Run(ctx, cfg, env, backup.Opts{})
+	var rerr *exec.RequirementError
+	require.True(t, errors.As(err, &rerr))
+
+	buf, err := afero.ReadFile(fs, "/state")
+	require.Nil(t, err)
+	state, err := config.LoadState(buf)
+	require.Nil(t, err)
+	lr := state["hourly"].LastRun()
+	require.NotNil(t, lr)
+	assert.True(t, lr.RequirementLost)
+	assert.False(t, lr.Interrupted)
+	assert.Equal(t, -1, lr.ExitStatus)
+}
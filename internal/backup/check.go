@@ -12,12 +12,13 @@ import (
 
 // ComputeOutdated returns the list of outdated backups.
 func ComputeOutdated(ctx context.Context, cfg config.Config, env Env) ([]Info, error) {
+	cfg = forHost(cfg, env.Host)
 	var res []Info
 	state := loadState(env.Sio)
 
 	for _, bc := range cfg.Backups {
 		clog := log.With().Str("backup", bc.Name).Logger()
-		t, ok := state.LastBackupOf(bc.Name)
+		t, ok := lastBackupOf(ctx, bc, state, env)
 		since := env.Clock.Now().Sub(t)
 		if ok && since < time.Duration(bc.Interval) {
 			clog.Info().Msgf("Skipping because: last backup was %s ago", fmtDuration(since))
@@ -28,8 +29,9 @@ func ComputeOutdated(ctx context.Context, cfg config.Config, env Env) ([]Info, e
 			since = 0
 		}
 		res = append(res, Info{
-			Since:  since,
-			Backup: bc,
+			Since:       since,
+			Interrupted: wasInterrupted(state[bc.Name]),
+			Backup:      bc,
 		})
 	}
 
@@ -40,15 +42,69 @@ func ComputeOutdated(ctx context.Context, cfg config.Config, env Env) ([]Info, e
 type Info struct {
 	// Since contains how long ago the backup was performed.
 	// Zero is a special value meaning "never".
-	Since  time.Duration
-	Backup config.Backup
+	Since time.Duration
+	// Interrupted is true when the last run was interrupted.
+	Interrupted bool
+	Backup      config.Backup
 }
 
 func (i Info) String() string {
+	res := fmt.Sprintf("%s: last backup was %s ago", i.Backup.Name, fmtDuration(i.Since))
 	if i.Since == 0 {
-		return fmt.Sprintf("%s: last backup was never?", i.Backup.Name)
+		res = fmt.Sprintf("%s: last backup was never?", i.Backup.Name)
 	}
-	return fmt.Sprintf("%s: last backup was %s ago", i.Backup.Name, fmtDuration(i.Since))
+	if i.Interrupted {
+		res += " (last run was interrupted)"
+	}
+	return res
+}
+
+func wasInterrupted(bs config.BackupState) bool {
+	lr := bs.LastRun()
+	return lr != nil && lr.Interrupted
+}
+
+// ComputeVerifyIssues returns the backups whose verification failed or is
+// overdue.
+func ComputeVerifyIssues(ctx context.Context, cfg config.Config, env Env) ([]VerifyInfo, error) {
+	cfg = forHost(cfg, env.Host)
+	var res []VerifyInfo
+	state := loadState(env.Sio)
+	now := env.Clock.Now()
+
+	for _, bc := range dueVerifications(cfg, state, now) {
+		key := config.VerifyStateKey(bc.Name)
+		info := VerifyInfo{Backup: bc}
+		if t, ok := state.LastBackupOf(key); ok {
+			info.Since = now.Sub(t)
+		}
+		if lr := state[key].LastRun(); lr != nil {
+			info.LastErr = lr.Error
+		}
+		res = append(res, info)
+	}
+
+	return res, nil
+}
+
+// VerifyInfo represents the state of a backup verification.
+type VerifyInfo struct {
+	// Since contains how long ago the last successful verification was
+	// performed. Zero is a special value meaning "never".
+	Since time.Duration
+	// LastErr is the error of the last verification, if it failed.
+	LastErr string
+	Backup  config.Backup
+}
+
+func (i VerifyInfo) String() string {
+	if i.LastErr != "" {
+		return fmt.Sprintf("%s: last verification failed: %s", i.Backup.Name, i.LastErr)
+	}
+	if i.Since == 0 {
+		return fmt.Sprintf("%s: never verified", i.Backup.Name)
+	}
+	return fmt.Sprintf("%s: last verified %s ago", i.Backup.Name, fmtDuration(i.Since))
 }
 
 func fmtDuration(d time.Duration) string {
@@ -63,3 +119,98 @@ func fmtDuration(d time.Duration) string {
 	}
 	return fmt.Sprintf("%d days", int(d/time.Hour/24))
 }
+
+// Status is the status of a configured backup.
+type Status struct {
+	Name     string          `json:"name"`
+	Interval config.Duration `json:"interval"`
+	// LastSuccess is the time of the last successful run, if any.
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	// Outdated is true when the backup needs to run.
+	Outdated bool `json:"outdated"`
+	// LastRun is the outcome of the last run, if any.
+	LastRun *config.RunInfo `json:"lastRun,omitempty"`
+	// Verify is the status of the verification, if configured.
+	Verify *VerifyStatus `json:"verify,omitempty"`
+	// OtherHost is true when the backup is not meant for the current host.
+	OtherHost bool `json:"otherHost,omitempty"`
+}
+
+// VerifyStatus is the status of the verification of a backup.
+type VerifyStatus struct {
+	// LastSuccess is the time of the last successful verification, if any.
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	// Due is true when the verification needs to run.
+	Due bool `json:"due"`
+	// LastRun is the outcome of the last verification, if any.
+	LastRun *config.RunInfo `json:"lastRun,omitempty"`
+}
+
+// ComputeStatus returns the status of the backups meant for the current
+// host, or of all the configured backups if allHosts is true.
+func ComputeStatus(ctx context.Context, cfg config.Config, env Env, allHosts bool) ([]Status, error) {
+	state := loadState(env.Sio)
+	now := env.Clock.Now()
+	var res []Status
+
+	for _, bc := range cfg.Backups {
+		otherHost := !bc.RunsOn(env.Host)
+		if otherHost && !allHosts {
+			continue
+		}
+		bs := state[bc.Name]
+		st := Status{
+			Name:      bc.Name,
+			Interval:  bc.Interval,
+			Outdated:  true,
+			LastRun:   bs.LastRun(),
+			OtherHost: otherHost,
+		}
+		if t, ok := lastBackupOf(ctx, bc, state, env); ok {
+			st.LastSuccess = &t
+			st.Outdated = now.Sub(t) >= time.Duration(bc.Interval)
+		}
+		if bc.Verify != nil {
+			key := config.VerifyStateKey(bc.Name)
+			vs := &VerifyStatus{
+				Due:     verifyDue(bc, state, now),
+				LastRun: state[key].LastRun(),
+			}
+			if t, ok := state.LastBackupOf(key); ok {
+				vs.LastSuccess = &t
+			}
+			st.Verify = vs
+		}
+		res = append(res, st)
+	}
+
+	return res, nil
+}
+
+// History returns the latest runs of the given backup, most recent first.
+func History(ctx context.Context, cfg config.Config, env Env, name string) ([]config.RunInfo, error) {
+	if !hasBackup(cfg, name) {
+		return nil, fmt.Errorf("unknown backup %q", name)
+	}
+	return loadState(env.Sio)[name].Runs, nil
+}
+
+// forHost returns a copy of the config, with only the backups meant for the
+// given host.
+func forHost(cfg config.Config, h config.Host) config.Config {
+	var backups []config.Backup
+	for _, b := range cfg.Backups {
+		if b.RunsOn(h) {
+			backups = append(backups, b)
+		} else {
+			log.Debug().Str("backup", b.Name).Msg("Ignoring because: not meant for this host")
+		}
+	}
+	cfg.Backups = backups
+	return cfg
+}
+
+func hasBackup(cfg config.Config, name string) bool {
+	_, ok := findBackup(cfg, name)
+	return ok
+}
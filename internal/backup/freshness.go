@@ -0,0 +1,105 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+
+	"github.com/mbrt/backsched/internal/config"
+	"github.com/mbrt/backsched/internal/exec"
+)
+
+// lastBackupOf returns the time of the last successful backup, reconciling
+// the local state with the freshness probe, if configured.
+func lastBackupOf(ctx context.Context, bc config.Backup, state config.State, env Env) (time.Time, bool) {
+	t, ok := state.LastBackupOf(bc.Name)
+	if bc.Freshness == nil {
+		return t, ok
+	}
+	pt, pok, err := probeFreshness(ctx, *bc.Freshness, env)
+	if err != nil {
+		log.Warn().Str("backup", bc.Name).Err(err).Msg("Probing freshness, using local state")
+		return t, ok
+	}
+	if bc.Freshness.Override || (pok && pt.After(t)) {
+		return pt, pok
+	}
+	return t, ok
+}
+
+// probeFreshness returns the time of the last backup according to the probe.
+// Returns false if the probe found no evidence of a backup.
+func probeFreshness(ctx context.Context, f config.Freshness, env Env) (time.Time, bool, error) {
+	switch {
+	case f.Marker != nil:
+		fi, err := env.Fs.Stat(*f.Marker)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return time.Time{}, false, nil
+			}
+			return time.Time{}, false, err
+		}
+		return fi.ModTime(), true, nil
+
+	case f.Newest != nil:
+		var newest time.Time
+		err := afero.Walk(env.Fs, *f.Newest, func(_ string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() && fi.ModTime().After(newest) {
+				newest = fi.ModTime()
+			}
+			return nil
+		})
+		if err != nil {
+			if os.IsNotExist(err) {
+				return time.Time{}, false, nil
+			}
+			return time.Time{}, false, err
+		}
+		return newest, !newest.IsZero(), nil
+
+	case f.Command != nil:
+		var out bytes.Buffer
+		err := env.Runner.Run(ctx, exec.Cmd{
+			Cmd:     f.Command.Cmd,
+			Args:    f.Command.Args,
+			Env:     f.Command.Env,
+			Workdir: f.Command.Workdir,
+			Stdout:  &out,
+		})
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		s := strings.TrimSpace(out.String())
+		if s == "" {
+			return time.Time{}, false, nil
+		}
+		t, err := parseTimestamp(s)
+		return t, err == nil, err
+	}
+
+	return time.Time{}, false, nil
+}
+
+// parseTimestamp parses an RFC 3339 timestamp or seconds since the epoch.
+func parseTimestamp(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	whole, frac := math.Modf(secs)
+	return time.Unix(int64(whole), int64(frac*1e9)), nil
+}
@@ -0,0 +1,166 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/mbrt/backsched/internal/config"
+)
+
+const (
+	// heartbeatLines is the number of output lines sent with the pings.
+	heartbeatLines = 100
+	// heartbeatLineMax is the maximum length of a line sent with the pings.
+	// Longer lines are truncated.
+	heartbeatLineMax = 1024
+	// heartbeatTimeout bounds every ping, so a slow monitoring service
+	// doesn't block the backups.
+	heartbeatTimeout = 10 * time.Second
+)
+
+// heartbeat pings the URLs configured in a backup. A nil heartbeat does
+// nothing.
+type heartbeat struct {
+	cfg  *config.Heartbeat
+	tail *tailWriter
+	log  zerolog.Logger
+}
+
+func newHeartbeat(cfg *config.Heartbeat, clog zerolog.Logger) *heartbeat {
+	if cfg == nil {
+		return nil
+	}
+	return &heartbeat{
+		cfg:  cfg,
+		tail: newTailWriter(heartbeatLines),
+		log:  clog,
+	}
+}
+
+// Output returns the writer collecting the output to send with the pings.
+func (h *heartbeat) Output() io.Writer {
+	if h == nil {
+		return nil
+	}
+	return h.tail
+}
+
+// Start pings the start URL.
+func (h *heartbeat) Start(ctx context.Context) {
+	if h == nil {
+		return
+	}
+	h.ping(ctx, h.cfg.Start, "")
+}
+
+// Done pings the success or failure URL, depending on the outcome of the
+// backup.
+func (h *heartbeat) Done(ctx context.Context, err error) {
+	if h == nil {
+		return
+	}
+	payload := h.tail.String()
+	if err != nil {
+		payload += fmt.Sprintf("\nbacksched: %v\n", err)
+		// The run context may be canceled already, but the failure should
+		// be reported anyway.
+		h.ping(context.Background(), h.cfg.Fail, payload)
+		return
+	}
+	h.ping(ctx, h.cfg.Success, payload)
+}
+
+func (h *heartbeat) ping(ctx context.Context, url, payload string) {
+	if url == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, heartbeatTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(payload))
+	if err != nil {
+		h.log.Warn().Err(err).Msg("Creating heartbeat request")
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.log.Warn().Err(err).Msg("Sending heartbeat")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		h.log.Warn().Msgf("Sending heartbeat: unexpected status %s", resp.Status)
+	}
+}
+
+// tailWriter keeps the last lines written to it.
+//
+// Carriage returns are line breaks too, so that progress bars redrawing the
+// same line are split, and lines are truncated to a maximum length.
+type tailWriter struct {
+	mu      sync.Mutex
+	max     int
+	maxLine int
+	lines   []string
+	partial bytes.Buffer
+	// cr is true if the last byte was a carriage return.
+	cr bool
+}
+
+func newTailWriter(max int) *tailWriter {
+	return &tailWriter{max: max, maxLine: heartbeatLineMax}
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range p {
+		cr := t.cr
+		t.cr = b == '\r'
+		switch {
+		case b == '\n' && cr:
+			// The line was ended by the carriage return already.
+		case b == '\n':
+			t.endLine()
+		case b == '\r':
+			if t.partial.Len() > 0 {
+				t.endLine()
+			}
+		case t.partial.Len() < t.maxLine:
+			t.partial.WriteByte(b)
+		}
+	}
+	return len(p), nil
+}
+
+func (t *tailWriter) endLine() {
+	t.lines = append(t.lines, t.partial.String())
+	t.partial.Reset()
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+// String returns the collected lines.
+func (t *tailWriter) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var sb strings.Builder
+	for _, l := range t.lines {
+		sb.WriteString(l)
+		sb.WriteByte('\n')
+	}
+	if t.partial.Len() > 0 {
+		sb.WriteString(t.partial.String())
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+
+	"github.com/mbrt/backsched/internal/config"
+)
+
+// WriteMetrics writes the metrics about the configured backups in the
+// Prometheus text format.
+func WriteMetrics(w io.Writer, cfg config.Config, env Env) error {
+	return writeMetrics(w, forHost(cfg, env.Host), loadState(env.Sio), env.Clock.Now())
+}
+
+// WriteMetricsFile atomically writes the metrics about the configured backups
+// to the given path, in the Prometheus text format.
+func WriteMetricsFile(path string, cfg config.Config, env Env) error {
+	return writeMetricsFileState(env.Fs, path, forHost(cfg, env.Host), loadState(env.Sio), env.Clock.Now())
+}
+
+func writeMetricsFile(env Env, cfg config.Config, state config.State, path string) {
+	if err := writeMetricsFileState(env.Fs, path, cfg, state, env.Clock.Now()); err != nil {
+		log.Error().Err(err).Msg("Writing metrics")
+	}
+}
+
+func writeMetricsFileState(fs afero.Fs, path string, cfg config.Config, state config.State, now time.Time) error {
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, cfg, state, now); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so the collector never reads a
+	// partial file.
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := afero.WriteFile(fs, tmp, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("writing %q: %w", tmp, err)
+	}
+	if err := fs.Rename(tmp, path); err != nil {
+		return fmt.Errorf("renaming %q: %w", tmp, err)
+	}
+	return nil
+}
+
+type metric struct {
+	name  string
+	help  string
+	value func(b config.Backup, s config.BackupState) (float64, bool)
+}
+
+func metrics(now time.Time) []metric {
+	return []metric{
+		{
+			name: "backsched_last_success_timestamp_seconds",
+			help: "Time of the last successful backup, zero if never.",
+			value: func(_ config.Backup, s config.BackupState) (float64, bool) {
+				return unixSeconds(s.LastSuccess), true
+			},
+		},
+		{
+			name: "backsched_last_duration_seconds",
+			help: "Duration of the last backup run.",
+			value: func(_ config.Backup, s config.BackupState) (float64, bool) {
+				if s.LastRun() == nil {
+					return 0, false
+				}
+				return time.Duration(s.LastRun().Duration).Seconds(), true
+			},
+		},
+		{
+			name: "backsched_last_exit_status",
+			help: "Exit status of the last backup run, -1 if it failed for other reasons.",
+			value: func(_ config.Backup, s config.BackupState) (float64, bool) {
+				if s.LastRun() == nil {
+					return 0, false
+				}
+				return float64(s.LastRun().ExitStatus), true
+			},
+		},
+		{
+			name: "backsched_interval_seconds",
+			help: "Configured interval between backups.",
+			value: func(b config.Backup, _ config.BackupState) (float64, bool) {
+				return time.Duration(b.Interval).Seconds(), true
+			},
+		},
+		{
+			name: "backsched_overdue",
+			help: "Whether the last successful backup is older than the interval.",
+			value: func(b config.Backup, s config.BackupState) (float64, bool) {
+				if s.LastSuccess.IsZero() || now.Sub(s.LastSuccess) >= time.Duration(b.Interval) {
+					return 1, true
+				}
+				return 0, true
+			},
+		},
+	}
+}
+
+func writeMetrics(w io.Writer, cfg config.Config, state config.State, now time.Time) error {
+	var buf bytes.Buffer
+	for _, m := range metrics(now) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n", m.name)
+		for _, b := range cfg.Backups {
+			v, ok := m.value(b, state[b.Name])
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(&buf, "%s{backup=\"%s\"} %s\n",
+				m.name, escapeLabel(b.Name), strconv.FormatFloat(v, 'f', -1, 64))
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
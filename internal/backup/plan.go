@@ -0,0 +1,178 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/mbrt/backsched/internal/config"
+	"github.com/mbrt/backsched/internal/exec"
+)
+
+// Plan describes what a backup run would do, without running anything.
+type Plan struct {
+	// Backups lists all the backups meant for the current host, in execution
+	// order.
+	Backups []PlannedBackup `json:"backups"`
+}
+
+// PlannedBackup describes what would happen to a backup.
+type PlannedBackup struct {
+	Name string `json:"name"`
+	// Due is true when the backup is outdated.
+	Due bool `json:"due"`
+	// Run is true when the backup is due and its requirements are satisfied.
+	Run bool `json:"run"`
+	// Reason explains the decision.
+	Reason string `json:"reason"`
+	// LastSuccess is the time of the last successful run, if any.
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	// Freshness is the outcome of the freshness probe, when it couldn't be
+	// used. Probe commands are never run while planning.
+	Freshness    string               `json:"freshness,omitempty"`
+	Requirements []PlannedRequirement `json:"requirements,omitempty"`
+	Commands     []PlannedCommand     `json:"commands"`
+	// ResumeFrom is the index of the first command to run, when resuming
+	// an incomplete run.
+	ResumeFrom int `json:"resumeFrom,omitempty"`
+	// Verify is the plan of the verification, if configured.
+	Verify *PlannedVerify `json:"verify,omitempty"`
+}
+
+// PlannedRequirement is the result of a requirement check.
+type PlannedRequirement struct {
+	Path string `json:"path,omitempty"`
+	OK   bool   `json:"ok"`
+	// Error is why the requirement is not satisfied.
+	Error string `json:"error,omitempty"`
+}
+
+// PlannedCommand is a command resolved from the config. Secret values are
+// never included: they are replaced by a placeholder with their ID.
+type PlannedCommand struct {
+	Cmd         string            `json:"cmd"`
+	Args        []string          `json:"args,omitempty"`
+	Workdir     string            `json:"workdir,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	SecretEnv   map[string]string `json:"secretEnv,omitempty"`
+	SecretFiles map[string]string `json:"secretFiles,omitempty"`
+	SecretStdin string            `json:"secretStdin,omitempty"`
+}
+
+// PlannedVerify describes what would happen to a verification.
+type PlannedVerify struct {
+	// Due is true when the verification would run after the backups.
+	Due      bool             `json:"due"`
+	Commands []PlannedCommand `json:"commands"`
+}
+
+// probeNotRun marks the freshness of backups whose probe is a command.
+const probeNotRun = "unknown (probe not run)"
+
+// ComputePlan returns what a backup run would do.
+func ComputePlan(ctx context.Context, cfg config.Config, env Env, opts Opts) (Plan, error) {
+	cfg = forHost(cfg, env.Host)
+	state := loadState(env.Sio)
+	now := env.Clock.Now()
+	due := map[string]bool{}
+	for _, b := range dueVerifications(cfg, state, now) {
+		due[b.Name] = true
+	}
+
+	res := Plan{Backups: []PlannedBackup{}}
+	for _, bc := range cfg.Backups {
+		pb := PlannedBackup{
+			Name:     bc.Name,
+			Due:      true,
+			Reason:   "never backed up",
+			Commands: planCommands(bc.Commands),
+		}
+		var (
+			t  time.Time
+			ok bool
+		)
+		if f := bc.Freshness; f != nil && f.Command != nil {
+			t, ok = state.LastBackupOf(bc.Name)
+			pb.Freshness = probeNotRun
+		} else {
+			t, ok = lastBackupOf(ctx, bc, state, env)
+		}
+		if ok {
+			pb.LastSuccess = &t
+			since := now.Sub(t)
+			pb.Due = since >= time.Duration(bc.Interval)
+			pb.Reason = fmt.Sprintf("last backup was %s ago, interval is %s",
+				fmtDuration(since), fmtDuration(time.Duration(bc.Interval)))
+		}
+
+		reqsOK := true
+		for _, r := range bc.Requires {
+			if r.Path == nil {
+				continue
+			}
+			pr := PlannedRequirement{Path: *r.Path, OK: true}
+			if err := (exec.DirExists{Path: *r.Path}).Check(ctx, env.Fs); err != nil {
+				pr.OK = false
+				pr.Error = err.Error()
+				if reqsOK {
+					reqsOK = false
+					if pb.Due {
+						pb.Reason += fmt.Sprintf(", but %v", err)
+					}
+				}
+			}
+			pb.Requirements = append(pb.Requirements, pr)
+		}
+		pb.Run = pb.Due && reqsOK
+		digest := config.CommandsDigest(bc.Commands)
+		if cp := resumeFrom(bc, state[bc.Name].Checkpoint, digest, opts, env.Clock.Now(), log.Logger); cp != nil {
+			pb.ResumeFrom = cp.Completed
+		}
+
+		if bc.Verify != nil && !opts.SkipVerify {
+			pb.Verify = &PlannedVerify{
+				// Backups running for the first time may be verified too.
+				Due:      due[bc.Name] || (pb.Run && pb.LastSuccess == nil),
+				Commands: planCommands(bc.Verify.Commands),
+			}
+		}
+		res.Backups = append(res.Backups, pb)
+	}
+	return res, nil
+}
+
+func planCommands(cmds []config.Command) []PlannedCommand {
+	res := []PlannedCommand{}
+	for _, c := range cmds {
+		pc := PlannedCommand{
+			Cmd:         c.Cmd,
+			Args:        c.Args,
+			Workdir:     c.Workdir,
+			Env:         c.Env,
+			SecretEnv:   maskSecrets(c.SecretEnv),
+			SecretFiles: maskSecrets(c.SecretFiles),
+		}
+		if c.SecretStdin != nil {
+			pc.SecretStdin = maskSecret(*c.SecretStdin)
+		}
+		res = append(res, pc)
+	}
+	return res
+}
+
+func maskSecrets(m map[string]config.Secret) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	res := map[string]string{}
+	for k, s := range m {
+		res[k] = maskSecret(s)
+	}
+	return res
+}
+
+func maskSecret(s config.Secret) string {
+	return fmt.Sprintf("<secret:%s>", s.ID)
+}
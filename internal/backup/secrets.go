@@ -0,0 +1,257 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/mbrt/backsched/internal/config"
+	"github.com/mbrt/backsched/internal/exec"
+)
+
+// secretKey identifies a secret value. Backup is empty for global secrets.
+type secretKey struct {
+	Backup string
+	ID     string
+}
+
+func keyOf(backup string, s config.Secret) secretKey {
+	if s.Global {
+		return secretKey{ID: s.ID}
+	}
+	return secretKey{Backup: backup, ID: s.ID}
+}
+
+// defaultSecretAttempts is how many times a secret failing validation is
+// asked, if not configured.
+const defaultSecretAttempts = 3
+
+// secretVals contains the collected secret values.
+type secretVals struct {
+	vals map[secretKey]string
+	// errs contains the secrets that failed validation.
+	errs map[secretKey]error
+}
+
+// collectSecrets asks all the secrets needed by the given backups, and their
+// verifications unless skipped, once. Nothing is asked if secrets are disabled.
+//
+// Secrets with a validation are asked again until valid, or until the
+// attempts are exhausted.
+//
+// This happens before running anything, so that the backups can then run
+// unattended. Failing to get a secret, e.g. because the user canceled the
+// prompt, or canceling ctx stops the collection.
+func collectSecrets(ctx context.Context, backups []config.Backup, env Env, opts Opts) (secretVals, error) {
+	res := secretVals{vals: map[secretKey]string{}, errs: map[secretKey]error{}}
+	if !opts.AskSecrets {
+		return res, nil
+	}
+	var sg SecretGetter = env.Secrets
+	if opts.DryRun {
+		sg = dryRunner{}
+	}
+
+	// Collect the secrets first, as the validation may be specified in only
+	// one of the places the secret is used.
+	var order []secretKey
+	secrets := map[secretKey]config.Secret{}
+	for _, bc := range backups {
+		for _, cmd := range usedCommands(bc, opts) {
+			for _, s := range commandSecrets(cmd) {
+				k := keyOf(bc.Name, s)
+				prev, ok := secrets[k]
+				if !ok {
+					order = append(order, k)
+				}
+				if !ok || prev.Validate == nil {
+					secrets[k] = s
+				}
+			}
+		}
+	}
+
+	for _, k := range order {
+		// Don't keep asking after e.g. Ctrl-C: prompts may not be
+		// interrupted by it.
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		s := secrets[k]
+		if s.Validate == nil || opts.DryRun {
+			val, err := sg.Secret(k.Backup, s)
+			if err != nil {
+				return res, fmt.Errorf("asking secret %q: %w", s.ID, err)
+			}
+			res.vals[k] = val
+			continue
+		}
+		val, err := askValid(ctx, k, s, sg, env.Runner)
+		if errors.As(err, new(*getError)) {
+			return res, err
+		}
+		if err != nil {
+			log.Error().Err(err).Str("backup", k.Backup).Msgf("Invalid secret ID=%s", s.ID)
+			res.errs[k] = err
+			continue
+		}
+		res.vals[k] = val
+	}
+	return res, nil
+}
+
+// getError is a failure to get a secret, as opposed to a validation failure.
+type getError struct {
+	id  string
+	err error
+}
+
+func (e *getError) Error() string {
+	return fmt.Sprintf("asking secret %q: %v", e.id, e.err)
+}
+
+func (e *getError) Unwrap() error {
+	return e.err
+}
+
+// askValid asks a secret until it passes validation.
+func askValid(ctx context.Context, k secretKey, s config.Secret, sg SecretGetter, r exec.Runner) (string, error) {
+	attempts := s.Validate.Attempts
+	if attempts <= 0 {
+		attempts = defaultSecretAttempts
+	}
+	var err error
+	for i := 1; i <= attempts; i++ {
+		val, gerr := sg.Secret(k.Backup, s)
+		if gerr != nil {
+			return "", &getError{id: s.ID, err: gerr}
+		}
+		if err = validateSecret(ctx, s.Validate, val, r); err == nil {
+			return val, nil
+		}
+		// The validation was interrupted: the value may be good.
+		if cerr := ctx.Err(); cerr != nil {
+			return "", &getError{id: s.ID, err: cerr}
+		}
+		// Don't get the same cached value again.
+		if inv, ok := sg.(SecretInvalidator); ok {
+			inv.Invalidate(k.Backup, s)
+		}
+		if i < attempts {
+			log.Warn().Err(err).Str("backup", k.Backup).
+				Msgf("Secret ID=%s is not valid, try again (%d/%d)", s.ID, i+1, attempts)
+		}
+	}
+	return "", fmt.Errorf("validation failed %d times: %w", attempts, err)
+}
+
+func validateSecret(ctx context.Context, v *config.SecretValidation, val string, r exec.Runner) error {
+	return r.Run(ctx, exec.Cmd{
+		Cmd:         v.Cmd,
+		Args:        v.Args,
+		Env:         v.Env,
+		Workdir:     v.Workdir,
+		SecretFiles: map[string]string{config.SecretFileEnv: val},
+	})
+}
+
+// check returns an error if any secret used by the commands failed
+// validation.
+func (v secretVals) check(backup string, cmds []config.Command) error {
+	for _, cmd := range cmds {
+		for _, s := range commandSecrets(cmd) {
+			if err, ok := v.errs[keyOf(backup, s)]; ok {
+				return fmt.Errorf("secret %q is not valid: %w", s.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// lookup returns the value of the given secret, if collected.
+func (v secretVals) lookup(backup string, s *config.Secret) *string {
+	if s == nil {
+		return nil
+	}
+	if val, ok := v.vals[keyOf(backup, *s)]; ok {
+		return &val
+	}
+	return nil
+}
+
+// lookupAll maps the variables to the values of their secrets. Secrets not
+// collected are omitted.
+func (v secretVals) lookupAll(backup string, m map[string]config.Secret) map[string]string {
+	res := map[string]string{}
+	for name, s := range m {
+		if val, ok := v.vals[keyOf(backup, s)]; ok {
+			res[name] = val
+		}
+	}
+	return res
+}
+
+// usedCommands returns the commands of the backup, including the
+// verification unless skipped.
+func usedCommands(bc config.Backup, opts Opts) []config.Command {
+	cmds := bc.Commands
+	if bc.Verify != nil && !opts.SkipVerify {
+		cmds = append(cmds[:len(cmds):len(cmds)], bc.Verify.Commands...)
+	}
+	return cmds
+}
+
+// commandSecrets returns all the secrets used by a command.
+func commandSecrets(cmd config.Command) []config.Secret {
+	res := append(sortedSecrets(cmd.SecretEnv), sortedSecrets(cmd.SecretFiles)...)
+	if cmd.SecretStdin != nil {
+		res = append(res, *cmd.SecretStdin)
+	}
+	return res
+}
+
+// sortedSecrets returns the secrets ordered by environment variable, so that
+// they are always asked in the same order.
+func sortedSecrets(env map[string]config.Secret) []config.Secret {
+	var names []string
+	for n := range env {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var res []config.Secret
+	for _, n := range names {
+		res = append(res, env[n])
+	}
+	return res
+}
+
+// SecretValue is the value of a secret asked by AskSecrets. Backup is empty
+// for global secrets.
+type SecretValue struct {
+	Backup string
+	ID     string
+	Value  string
+}
+
+// AskSecrets asks all the secrets needed by the backups meant for the
+// current host, and their verifications, e.g. to unlock them in advance.
+func AskSecrets(ctx context.Context, cfg config.Config, env Env) ([]SecretValue, error) {
+	vals, err := collectSecrets(ctx, forHost(cfg, env.Host).Backups, env, Opts{AskSecrets: true})
+	if err != nil {
+		return nil, err
+	}
+	var res []SecretValue
+	for k, v := range vals.vals {
+		res = append(res, SecretValue{Backup: k.Backup, ID: k.ID, Value: v})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Backup != res[j].Backup {
+			return res[i].Backup < res[j].Backup
+		}
+		return res[i].ID < res[j].ID
+	})
+	return res, nil
+}
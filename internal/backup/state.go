@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/mbrt/backsched/internal/config"
+)
+
+// Mark records the given backup as successfully done at the given time, e.g.
+// because it was performed manually.
+func Mark(ctx context.Context, cfg config.Config, env Env, name string, t time.Time) error {
+	if !hasBackup(cfg, name) {
+		return fmt.Errorf("unknown backup %q", name)
+	}
+	return updateState(ctx, env.Sio, func(s config.State) error {
+		s.MarkSuccess(name, t, env.Clock.Now())
+		return nil
+	})
+}
+
+// Reset forgets the last successful run of the given backups, so that they
+// are considered never done.
+func Reset(ctx context.Context, cfg config.Config, env Env, names []string) error {
+	for _, name := range names {
+		if !hasBackup(cfg, name) {
+			return fmt.Errorf("unknown backup %q", name)
+		}
+	}
+	return updateState(ctx, env.Sio, func(s config.State) error {
+		for _, name := range names {
+			s.Reset(name, env.Clock.Now())
+		}
+		return nil
+	})
+}
+
+// Rename moves the state of a backup to a new name, after the backup was
+// renamed in the config.
+func Rename(ctx context.Context, cfg config.Config, env Env, from, to string) error {
+	if !hasBackup(cfg, to) {
+		return fmt.Errorf("unknown backup %q", to)
+	}
+	return updateState(ctx, env.Sio, func(s config.State) error {
+		return s.Rename(from, to, env.Clock.Now())
+	})
+}
+
+// Prune removes the state of the backups no longer in the config, and
+// returns the removed entries.
+func Prune(ctx context.Context, cfg config.Config, env Env) ([]string, error) {
+	var names []string
+	for _, b := range cfg.Backups {
+		names = append(names, b.Name)
+	}
+	var res []string
+	err := updateState(ctx, env.Sio, func(s config.State) error {
+		res = s.Prune(names, env.Clock.Now())
+		return nil
+	})
+	return res, err
+}
+
+// updateState applies the given change to the stored state.
+//
+// Shared stores are locked for the whole update.
+func updateState(ctx context.Context, sio StateIOer, f func(config.State) error) error {
+	unlock, err := lockState(ctx, sio)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state := config.State{}
+	buf, err := sio.Load()
+	if err != nil {
+		// There may be no state yet.
+		log.Warn().Err(err).Msg("Loading state")
+	} else if state, err = config.LoadState(buf); err != nil {
+		// Refuse to overwrite a state we can't read.
+		return fmt.Errorf("parsing state: %w", err)
+	}
+	if err := f(state); err != nil {
+		return err
+	}
+	if buf, err = state.Save(); err != nil {
+		return fmt.Errorf("serializing state: %w", err)
+	}
+	return sio.Save(buf)
+}
+
+// lockState locks shared state stores, waiting at most stateLockTimeout, and
+// returns the function releasing the lock. Other stores are not locked.
+func lockState(ctx context.Context, sio StateIOer) (func(), error) {
+	l, ok := sio.(StateLocker)
+	if !ok {
+		return func() {}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, stateLockTimeout)
+	defer cancel()
+	unlock, err := l.Lock(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("locking state: %w", err)
+	}
+	return func() {
+		if err := unlock(); err != nil {
+			log.Error().Err(err).Msg("Unlocking state")
+		}
+	}, nil
+}
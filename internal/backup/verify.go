@@ -0,0 +1,163 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+
+	"github.com/mbrt/backsched/internal/config"
+)
+
+// Verify runs the restore tests of the given backups. If no names are given,
+// only the verifications that are due are executed.
+//
+// Shared state stores are locked for the whole run.
+func Verify(ctx context.Context, cfg config.Config, env Env, opts Opts, names []string) error {
+	if !opts.DryRun {
+		unlock, err := lockState(ctx, env.Sio)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	var backups []config.Backup
+	if len(names) == 0 {
+		backups = dueVerifications(forHost(cfg, env.Host), loadState(env.Sio), env.Clock.Now())
+	} else {
+		for _, name := range names {
+			b, ok := findBackup(cfg, name)
+			if !ok {
+				return fmt.Errorf("unknown backup %q", name)
+			}
+			if b.Verify == nil {
+				return fmt.Errorf("backup %q has no verify section", name)
+			}
+			if !b.RunsOn(env.Host) {
+				return fmt.Errorf("backup %q is not meant for this host", name)
+			}
+			backups = append(backups, b)
+		}
+	}
+
+	state := config.State{}
+	if opts.DryRun {
+		env.Runner = dryRunner{}
+	} else {
+		state = loadState(env.Sio)
+		defer saveState(env.Sio, state)
+	}
+	secrets, err := collectSecrets(ctx, backups, env, opts)
+	if err != nil {
+		return err
+	}
+	return runVerifications(ctx, backups, env, opts, secrets, state)
+}
+
+// dryRunVerifyDir replaces the temporary directory of the verifications in
+// dry runs, where nothing is created.
+const dryRunVerifyDir = "<temp-dir>"
+
+func runVerifications(ctx context.Context, backups []config.Backup, env Env, opts Opts, secrets secretVals, state config.State) error {
+	var firstErr error
+	for _, b := range backups {
+		if ctx.Err() != nil {
+			// Don't start new verifications once interrupted.
+			if firstErr == nil {
+				firstErr = ctx.Err()
+			}
+			break
+		}
+		if err := verify(ctx, b, env, opts, secrets, state); err != nil {
+			log.Error().Str("backup", b.Name).Err(err).Msg("Verification failed")
+			if firstErr == nil {
+				firstErr = fmt.Errorf("verifying backup %q: %w", b.Name, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+func verify(ctx context.Context, bc config.Backup, env Env, opts Opts, secrets secretVals, state config.State) error {
+	clog := log.With().Str("backup", bc.Name).Logger()
+	// The verification has the same requirements of the backup.
+	vb := config.Backup{
+		Name:     bc.Name,
+		Commands: bc.Verify.Commands,
+		Requires: bc.Requires,
+	}
+	if err := secrets.check(bc.Name, vb.Commands); err != nil {
+		return err
+	}
+	e := newExecutorFromConfig(vb, env, secrets)
+	if err := e.CanExecute(ctx); err != nil {
+		clog.Info().Msgf("Skipping verification because: %v", err)
+		return nil
+	}
+
+	dir := dryRunVerifyDir
+	if !opts.DryRun {
+		var err error
+		dir, err = afero.TempDir(env.Fs, "", "backsched-verify-")
+		if err != nil {
+			return fmt.Errorf("creating temp dir: %w", err)
+		}
+		defer func() {
+			if err := env.Fs.RemoveAll(dir); err != nil {
+				clog.Warn().Err(err).Msgf("Removing %q", dir)
+			}
+		}()
+	}
+	for i, c := range e.Cfg.Cmds {
+		env := map[string]string{config.VerifyDirEnv: dir}
+		for k, v := range c.Env {
+			env[k] = v
+		}
+		e.Cfg.Cmds[i].Env = env
+	}
+
+	clog.Info().Msg("Verifying")
+	start := env.Clock.Now()
+	err := e.Run(ctx)
+	state.RecordRun(config.VerifyStateKey(bc.Name), runInfo(ctx, start, env.Clock.Now(), err))
+	return err
+}
+
+// dueVerifications returns the backups whose verification is due. Backups
+// never completed successfully have nothing to verify.
+func dueVerifications(cfg config.Config, state config.State, now time.Time) []config.Backup {
+	var res []config.Backup
+	for _, b := range cfg.Backups {
+		if b.Verify == nil {
+			continue
+		}
+		if _, ok := state.LastBackupOf(b.Name); !ok {
+			continue
+		}
+		if verifyDue(b, state, now) {
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
+func verifyDue(b config.Backup, state config.State, now time.Time) bool {
+	vs := state[config.VerifyStateKey(b.Name)]
+	if lr := vs.LastRun(); lr != nil && lr.Error != "" {
+		// Retry failed verifications at every run.
+		return true
+	}
+	t, ok := state.LastBackupOf(config.VerifyStateKey(b.Name))
+	return !ok || now.Sub(t) >= time.Duration(b.Verify.Interval)
+}
+
+func findBackup(cfg config.Config, name string) (config.Backup, bool) {
+	for _, b := range cfg.Backups {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return config.Backup{}, false
+}
@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"filippo.io/age"
 	"github.com/google/go-jsonnet"
 
 	"github.com/mbrt/backsched/internal/errors"
@@ -25,11 +28,47 @@ var defaultEnv = []string{
 type Config struct {
 	Version string   `json:"version"`
 	Backups []Backup `json:"backups"`
+	// Metrics optionally configures the export of backup metrics.
+	Metrics *Metrics `json:"metrics,omitempty"`
+	// State optionally configures where the state of the backups is stored.
+	// Defaults to the config directory.
+	State *StateStore `json:"state,omitempty"`
+}
+
+// StateStore configures a state store shared by multiple machines. Only one
+// of the fields must be set.
+type StateStore struct {
+	// Path is the path to a state file on a shared filesystem (e.g. a NAS).
+	Path *string `json:"path,omitempty"`
+	// S3 is an object in an S3-compatible object store.
+	S3 *S3Store `json:"s3,omitempty"`
+}
+
+// S3Store is a state store in an S3-compatible object store.
+//
+// Credentials are taken from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+// environment variables.
+type S3Store struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.amazonaws.com.
+	Endpoint string `json:"endpoint"`
+	// Region is the region of the bucket. Defaults to us-east-1.
+	Region string `json:"region,omitempty"`
+	Bucket string `json:"bucket"`
+	// Key is the name of the state object.
+	Key string `json:"key"`
+}
+
+// Metrics configures the export of backup metrics.
+type Metrics struct {
+	// Textfile is the path to a file where metrics are written in the
+	// Prometheus text format after every backup run. Meant to be used with
+	// the node_exporter textfile collector.
+	Textfile string `json:"textfile"`
 }
 
 // Backup is the configuration for a backup.
 type Backup struct {
-	// Name is the name of the backup. Must be unique.
+	// Name is the name of the backup. Must be unique, and can't contain ':'.
 	Name string `json:"name"`
 	// Commands is a list of commands to execute in order.
 	Commands []Command `json:"commands"`
@@ -37,6 +76,79 @@ type Backup struct {
 	Requires []Requirement `json:"requires,omitempty"`
 	// Interval is the time interval between backups.
 	Interval Duration `json:"interval"`
+	// Heartbeat optionally configures URLs to ping when the backup runs.
+	Heartbeat *Heartbeat `json:"heartbeat,omitempty"`
+	// Verify optionally configures a periodic restore test of the backup.
+	Verify *Verify `json:"verify,omitempty"`
+	// Freshness is an optional probe of the destination, telling when the
+	// last backup was done, regardless of the local state.
+	Freshness *Freshness `json:"freshness,omitempty"`
+	// Hosts optionally restricts the backup to the given hostnames. Glob
+	// patterns (e.g. 'laptop-*') are supported.
+	Hosts []string `json:"hosts,omitempty"`
+	// Platforms optionally restricts the backup to the given platforms, in
+	// the form 'os' or 'os/arch' (e.g. 'linux', 'darwin/arm64'). Glob
+	// patterns are supported.
+	Platforms []string `json:"platforms,omitempty"`
+	// Resumable makes a failed or interrupted run continue from the first
+	// command not yet completed, instead of starting over. Runs older than
+	// the interval start over anyway.
+	Resumable bool `json:"resumable,omitempty"`
+}
+
+// Freshness is a probe returning the time of the last backup from evidence
+// in the destination. Only one of the fields must be set.
+type Freshness struct {
+	// Marker is a file whose modification time is the time of the last
+	// backup.
+	Marker *string `json:"marker,omitempty"`
+	// Newest is a path whose newest file, recursively, has the modification
+	// time of the last backup.
+	Newest *string `json:"newest,omitempty"`
+	// Command is a command printing the time of the last backup, either in
+	// RFC 3339 format or as seconds since the Unix epoch.
+	Command *ProbeCommand `json:"command,omitempty"`
+	// Override makes the probe result replace the local state. By default
+	// the most recent of the two is used.
+	Override bool `json:"override,omitempty"`
+}
+
+// Verify configures a restore test for a backup.
+//
+// The commands are expected to restore a sample of the backup into the
+// temporary directory passed in the VerifyDirEnv environment variable, and
+// to compare it with the original. The directory is removed afterwards.
+type Verify struct {
+	// Commands is a list of commands to execute in order.
+	Commands []Command `json:"commands"`
+	// Interval is the time interval between verifications.
+	Interval Duration `json:"interval"`
+}
+
+// VerifyDirEnv is the environment variable containing the temporary
+// directory available to the verify commands.
+const VerifyDirEnv = "BACKSCHED_VERIFY_DIR"
+
+// stateKeySep separates the backup name from the suffix of the other state
+// keys of the backup. Backup names can't contain it, so that keys don't
+// collide.
+const stateKeySep = ":"
+
+// VerifyStateKey returns the key under which the state of the verification
+// of the given backup is stored.
+func VerifyStateKey(backup string) string {
+	return backup + stateKeySep + "verify"
+}
+
+// Heartbeat contains the URLs to ping during a backup run, to allow external
+// monitoring (e.g. with healthchecks.io). All the URLs are optional.
+type Heartbeat struct {
+	// Start is pinged when the backup starts.
+	Start string `json:"start,omitempty"`
+	// Success is pinged when the backup completes successfully.
+	Success string `json:"success,omitempty"`
+	// Fail is pinged when the backup fails.
+	Fail string `json:"fail,omitempty"`
 }
 
 // Command represents a command to run.
@@ -44,7 +156,7 @@ type Command struct {
 	// Cmd is the full path to the command to run.
 	Cmd string `json:"cmd"`
 	// Args is the list of arguments to pass
-	Args []string `json:"args"`
+	Args []string `json:"args,omitempty"`
 	// Env is a map of environment variables with their value.
 	Env map[string]string `json:"env,omitempty"`
 	// Workdir specifies the working directory.
@@ -55,6 +167,28 @@ type Command struct {
 	// If the same identifier is used by multiple variables within a backup,
 	// the value will be asked only once and the value used multiple times.
 	SecretEnv map[string]Secret `json:"secretEnv,omitempty"`
+	// SecretFiles is like SecretEnv, but the variables are set to the path of
+	// a temporary file containing the secret, readable only by the user and
+	// removed after the command. This avoids exposing the secret in the
+	// process environment. `${VAR}` in args is replaced by the path too, e.g.
+	// for `--password-file=${PASSWORD_FILE}`.
+	SecretFiles map[string]Secret `json:"secretFiles,omitempty"`
+	// SecretStdin is a secret written to the command standard input.
+	SecretStdin *Secret `json:"secretStdin,omitempty"`
+}
+
+// ProbeCommand is a command run to inspect the state of a backup. Probes run
+// before any secret is asked, so they can't use secrets.
+type ProbeCommand struct {
+	// Cmd is the full path to the command to run.
+	Cmd string `json:"cmd"`
+	// Args is the list of arguments to pass
+	Args []string `json:"args,omitempty"`
+	// Env is a map of environment variables with their value.
+	Env map[string]string `json:"env,omitempty"`
+	// Workdir specifies the working directory.
+	// Defaults to the current directory.
+	Workdir string `json:"workdir,omitempty"`
 }
 
 // Requirement is a backup requirement.
@@ -68,20 +202,170 @@ type Requirement struct {
 // with a unique string and asked at runtime.
 type Secret struct {
 	ID string `json:"id"`
+	// Global secrets are shared by all the backups using the same ID, and
+	// asked only once. Otherwise the ID is scoped to the backup.
+	Global bool `json:"global,omitempty"`
+	// Validate is an optional command checking the secret right after it's
+	// entered, so that typos are caught before running the backups.
+	Validate *SecretValidation `json:"validate,omitempty"`
+}
+
+// SecretFileEnv is the environment variable pointing to the file containing
+// the secret to validate.
+const SecretFileEnv = "BACKSCHED_SECRET_FILE"
+
+// SecretValidation is a command validating a secret, e.g. by opening the
+// backup repository with it. The secret is written to a temporary file, whose
+// path is in the BACKSCHED_SECRET_FILE variable, also replaced in args as
+// `${BACKSCHED_SECRET_FILE}`.
+//
+// If the command fails, the secret is asked again. After all the attempts
+// fail, the backups using the secret are skipped.
+type SecretValidation struct {
+	// Cmd is the full path to the command to run.
+	Cmd string `json:"cmd"`
+	// Args is the list of arguments to pass
+	Args []string `json:"args,omitempty"`
+	// Env is a map of environment variables with their value.
+	Env map[string]string `json:"env,omitempty"`
+	// Workdir specifies the working directory.
+	Workdir string `json:"workdir,omitempty"`
+	// Attempts is how many times the secret is asked. Defaults to 3.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// EvalOpts contains the parameters passed to the config evaluation.
+type EvalOpts struct {
+	// ExtStrs are additional string external variables (`std.extVar`).
+	ExtStrs map[string]string
+	// ExtCodes are additional external variables, evaluated as code.
+	ExtCodes map[string]string
+	// TLAStrs are string top-level arguments. They are used only if the
+	// config evaluates to a function.
+	TLAStrs map[string]string
+	// Env is a list of environment variables to pass as external variables,
+	// in addition to the default ones.
+	Env []string
+	// Identities decrypt the values encrypted with `decrypt`.
+	Identities []age.Identity
+	// Redact replaces the encrypted values with RedactedValue instead of
+	// decrypting them, e.g. to print the config.
+	Redact bool
 }
 
 // Parse takes a file path and returns a parsed config.
+//
+// Configs in older versions of the format are migrated to the latest one.
 func Parse(path string) (Config, error) {
-	var cfg Config
+	return ParseWith(path, EvalOpts{})
+}
+
+// ParseWith is like Parse, but evaluates the config with the given options.
+//
+// Backups defined in the files under the IncludeDir directory, next to the
+// config, are appended to the ones in the main config.
+func ParseWith(path string, opts EvalOpts) (Config, error) {
+	cfg, err := parseFile(path, opts)
+	if err != nil {
+		return cfg, err
+	}
+	incs, err := includeFiles(filepath.Join(filepath.Dir(path), IncludeDir))
+	if err != nil {
+		return cfg, err
+	}
+	if len(incs) == 0 {
+		return cfg, nil
+	}
+
+	sources := map[string]string{}
+	for _, b := range cfg.Backups {
+		sources[b.Name] = path
+	}
+	for _, inc := range incs {
+		icfg, err := parseFile(inc, opts)
+		if err != nil {
+			return cfg, fmt.Errorf("in %q: %w", inc, err)
+		}
+		if icfg.Metrics != nil || icfg.State != nil {
+			return cfg, fmt.Errorf("in %q: only backups can be defined in %s", inc, IncludeDir)
+		}
+		for _, b := range icfg.Backups {
+			if src, ok := sources[b.Name]; ok {
+				return cfg, fmt.Errorf("backup names have to be unique, %q is defined in both %q and %q",
+					b.Name, src, inc)
+			}
+			sources[b.Name] = inc
+			cfg.Backups = append(cfg.Backups, b)
+		}
+	}
+	return cfg, nil
+}
+
+func parseFile(path string, opts EvalOpts) (Config, error) {
+	js, err := Evaluate(path, opts)
+	if err != nil {
+		return Config{}, err
+	}
+	return Decode(js)
+}
+
+// Evaluate evaluates the given config file and returns the resulting JSON,
+// in whatever version the config is written.
+//
+// The format is detected by the file extension: Jsonnet, YAML and plain JSON
+// are supported. The evaluation options apply to Jsonnet configs only.
+func Evaluate(path string, opts EvalOpts) ([]byte, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonnet", ".libsonnet":
+		return evaluateJsonnet(path, opts)
+	case ".json":
+		return readJSON(path)
+	case ".yaml", ".yml":
+		return readYAML(path)
+	default:
+		return nil, fmt.Errorf("unknown config format for %q", path)
+	}
+}
+
+func evaluateJsonnet(path string, opts EvalOpts) ([]byte, error) {
 	vm := jsonnet.MakeVM()
+	vm.Importer(newBundledImporter())
+	registerNativeFuncs(vm)
+	vm.NativeFunction(decryptFunc(opts))
 	for _, v := range defaultEnv {
 		vm.ExtVar(v, os.Getenv(v))
 	}
+	for _, v := range opts.Env {
+		vm.ExtVar(v, os.Getenv(v))
+	}
+	for k, v := range opts.ExtStrs {
+		vm.ExtVar(k, v)
+	}
+	for k, v := range opts.ExtCodes {
+		vm.ExtCode(k, v)
+	}
+	for k, v := range opts.TLAStrs {
+		vm.TLAVar(k, v)
+	}
 	js, err := vm.EvaluateFile(path)
 	if err != nil {
-		return cfg, fmt.Errorf("evaluate jsonnet: %w", err)
+		return nil, fmt.Errorf("evaluate jsonnet: %w", err)
 	}
-	err = jsonUnmarshalStrict([]byte(js), &cfg)
+	return []byte(js), nil
+}
+
+// Decode migrates an evaluated config to the latest version, validates and
+// decodes it.
+func Decode(js []byte) (Config, error) {
+	var cfg Config
+	_, js, err := Migrate(js)
+	if err != nil {
+		return cfg, err
+	}
+	if err := validateSchema(js); err != nil {
+		return cfg, err
+	}
+	err = jsonUnmarshalStrict(js, &cfg)
 	if err != nil {
 		return cfg, fmt.Errorf("json unmarshal: %w", err)
 	}
@@ -132,10 +416,60 @@ func checkConfig(cfg Config) error {
 			return fmt.Errorf("backup names have to be unique, %q is duplicate", b.Name)
 		}
 		names[b.Name] = true
+		if strings.Contains(b.Name, stateKeySep) {
+			return fmt.Errorf("backup %q: names can't contain %q", b.Name, stateKeySep)
+		}
+		if err := checkFreshness(b.Freshness); err != nil {
+			return fmt.Errorf("backup %q: %w", b.Name, err)
+		}
+		if err := checkHosts(b); err != nil {
+			return fmt.Errorf("backup %q: %w", b.Name, err)
+		}
+	}
+	if st := cfg.State; st != nil && (st.Path == nil) == (st.S3 == nil) {
+		return errors.New("state needs exactly one of path or s3")
+	}
+	return nil
+}
+
+func checkFreshness(f *Freshness) error {
+	if f == nil {
+		return nil
+	}
+	count := 0
+	for _, set := range []bool{f.Marker != nil, f.Newest != nil, f.Command != nil} {
+		if set {
+			count++
+		}
+	}
+	if count != 1 {
+		return errors.New("freshness needs exactly one of marker, newest or command")
 	}
 	return nil
 }
 
+// configSchema is JSONSchema, generated once.
+var configSchema = JSONSchema()
+
+// validateSchema checks the evaluated config against JSONSchema, reporting
+// every violation with its JSON pointer.
+func validateSchema(buf []byte) error {
+	errs, err := configSchema.Validate(buf)
+	if err != nil {
+		return fmt.Errorf("json unmarshal: %w", err)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	var details []string
+	for _, e := range errs[1:] {
+		details = append(details, e.Error())
+	}
+	return errors.WithDetails(
+		fmt.Errorf("invalid config (%d errors): %w", len(errs), errs[0]),
+		details...)
+}
+
 func jsonUnmarshalStrict(buf []byte, v interface{}) error {
 	dec := json.NewDecoder(bytes.NewReader(buf))
 	dec.DisallowUnknownFields()
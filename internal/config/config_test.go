@@ -6,9 +6,12 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"filippo.io/age"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -67,7 +70,7 @@ func TestParse(t *testing.T) {
 }
 
 func TestParseErr(t *testing.T) {
-	tpaths := paths(t, "testfiles/err-*.jsonnet")
+	tpaths := paths(t, "testfiles/err-*")
 	for _, tp := range tpaths {
 		t.Run(tp, func(t *testing.T) {
 			_, err := config.Parse(tp)
@@ -75,3 +78,554 @@ func TestParseErr(t *testing.T) {
 		})
 	}
 }
+
+func TestParseFormats(t *testing.T) {
+	expected, err := config.Parse("testfiles/formats/config.jsonnet")
+	require.Nil(t, err)
+	for _, ext := range []string{".yaml", ".json"} {
+		t.Run(ext, func(t *testing.T) {
+			cfg, err := config.Parse("testfiles/formats/config" + ext)
+			require.Nil(t, err)
+			assert.Equal(t, expected, cfg)
+		})
+	}
+}
+
+func TestSchema(t *testing.T) {
+	const goldenp = "testfiles/schema.json"
+	schema := config.JSONSchema()
+	if *update {
+		dumpJSON(t, goldenp, schema)
+		return
+	}
+	b, err := json.MarshalIndent(schema, "", "  ")
+	require.Nil(t, err)
+	golden, err := os.ReadFile(goldenp)
+	require.Nil(t, err)
+	assert.Equal(t, string(golden), string(b))
+}
+
+func TestSchemaErrPaths(t *testing.T) {
+	cases := []struct {
+		name string
+		js   string
+		errs []string
+	}{
+		{
+			name: "valid",
+			js:   `{"version": "v1alpha1", "backups": [{"name": "a", "interval": "1h", "commands": []}]}`,
+		},
+		{
+			name: "unknown field",
+			js:   `{"version": "v1alpha1", "backups": [{"name": "a", "interval": "1h", "commands": [], "foo": 1}]}`,
+			errs: []string{"/backups/0/foo: unknown field"},
+		},
+		{
+			name: "missing fields",
+			js:   `{"backups": [{"name": "a", "commands": [{"args": []}]}]}`,
+			errs: []string{
+				`/: missing required field "version"`,
+				`/backups/0: missing required field "interval"`,
+				`/backups/0/commands/0: missing required field "cmd"`,
+			},
+		},
+		{
+			name: "wrong types",
+			js: `{"version": "v1alpha1", "backups": [{"name": "a", "interval": "1 day", "commands": [
+				{"cmd": "echo", "args": [1], "secretEnv": {"A/B": {"id": true}}}
+			]}]}`,
+			errs: []string{
+				"/backups/0/commands/0/args/0: expected string, got number",
+				"/backups/0/commands/0/secretEnv/A~1B/id: expected string, got boolean",
+				`/backups/0/interval: invalid value "1 day": expected a duration, either as a string (e.g. '24h') or in nanoseconds`,
+			},
+		},
+		{
+			name: "secret in probe",
+			js: `{"version": "v1alpha1", "backups": [{"name": "a", "interval": "1h", "commands": [],
+				"freshness": {"command": {"cmd": "restic", "secretEnv": {"PASS": {"id": "repo"}}}}}]}`,
+			errs: []string{"/backups/0/freshness/command/secretEnv: unknown field"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			errs, err := config.JSONSchema().Validate([]byte(tc.js))
+			require.Nil(t, err)
+			var got []string
+			for _, e := range errs {
+				got = append(got, e.Error())
+			}
+			assert.Equal(t, tc.errs, got)
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	restore := config.SetMigrations("v0test", func(doc map[string]interface{}) error {
+		doc["backups"] = doc["jobs"]
+		delete(doc, "jobs")
+		return nil
+	})
+	defer restore()
+
+	assert.Equal(t, []string{"v0test", config.Version}, config.KnownVersions())
+
+	js, err := config.Evaluate("testfiles/old-version.jsonnet", config.EvalOpts{})
+	require.Nil(t, err)
+	from, migrated, err := config.Migrate(js)
+	require.Nil(t, err)
+	assert.Equal(t, "v0test", from)
+	assert.JSONEq(t, `{
+		"version": "v1alpha1",
+		"backups": [{"name": "backup1", "interval": "1h", "commands": [{"cmd": "echo", "args": ["foo"]}]}]
+	}`, string(migrated))
+
+	// Parse goes through the same pipeline.
+	cfg, err := config.Parse("testfiles/old-version.jsonnet")
+	require.Nil(t, err)
+	assert.Equal(t, config.Version, cfg.Version)
+	assert.Equal(t, "backup1", cfg.Backups[0].Name)
+
+	// The latest version is left untouched.
+	from, migrated2, err := config.Migrate(migrated)
+	require.Nil(t, err)
+	assert.Equal(t, config.Version, from)
+	assert.Equal(t, migrated, migrated2)
+
+	// Unknown versions are still rejected.
+	_, _, err = config.Migrate([]byte(`{"version": "v2"}`))
+	assert.NotNil(t, err)
+}
+
+func TestMigrateFile(t *testing.T) {
+	restore := config.SetMigrations("v0test", func(doc map[string]interface{}) error {
+		doc["backups"] = doc["jobs"]
+		delete(doc, "jobs")
+		return nil
+	})
+	defer restore()
+
+	m, err := config.MigrateFile("testfiles/old-version.jsonnet", config.EvalOpts{})
+	require.Nil(t, err)
+	assert.Equal(t, "v0test", m.From)
+	assert.False(t, m.Encrypted)
+	assert.Equal(t, `--- v0test
++++ v1alpha1
+ {
+-  "jobs": [
++  "backups": [
+     {
+       "commands": [
+         {
+           "args": [
+             "foo"
+           ],
+           "cmd": "echo"
+         }
+       ],
+       "interval": "1h",
+       "name": "backup1"
+     }
+   ],
+-  "version": "v0test"
++  "version": "v1alpha1"
+ }
+`, m.Diff())
+
+	// The migrated config is valid.
+	p := filepath.Join(t.TempDir(), "config.json")
+	require.Nil(t, os.WriteFile(p, []byte(m.After), 0o600))
+	cfg, err := config.Parse(p)
+	require.Nil(t, err)
+	assert.Equal(t, "backup1", cfg.Backups[0].Name)
+
+	// Encrypted values are redacted and reported.
+	p = filepath.Join(t.TempDir(), "config.jsonnet")
+	require.Nil(t, os.WriteFile(p, []byte(`
+local bs = import 'backsched.libsonnet';
+{
+  version: 'v0test',
+  jobs: [{
+    name: 'b1',
+    interval: '1h',
+    commands: [{ cmd: 'true', env: { PASS: bs.decrypt('ciphertext') } }],
+  }],
+}`), 0o600))
+	m, err = config.MigrateFile(p, config.EvalOpts{})
+	require.Nil(t, err)
+	assert.True(t, m.Encrypted)
+	assert.Contains(t, m.After, `"PASS": "<encrypted>"`)
+}
+
+func TestBundledLibrary(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		require.Nil(t, os.WriteFile(p, []byte(content), 0o600))
+		return p
+	}
+	cfgp := writeFile("config.jsonnet", `
+local lib = import 'backsched.libsonnet';
+local v1 = import 'backsched/v1.libsonnet';
+{
+  version: 'v1alpha1',
+  backups: [
+    {name: 'latest', interval: '1h', commands: lib.rsync('/a', '/b')},
+    {name: 'v1', interval: '1h', commands: v1.rsync('/a', '/b')},
+  ],
+}`)
+
+	// Without local files, the bundled library is used.
+	cfg, err := config.Parse(cfgp)
+	require.Nil(t, err)
+	require.Len(t, cfg.Backups, 2)
+	assert.Equal(t, "rsync", cfg.Backups[0].Commands[1].Cmd)
+	assert.Equal(t, cfg.Backups[0].Commands, cfg.Backups[1].Commands)
+
+	// A local file overrides the bundled one.
+	writeFile("backsched.libsonnet", `{ rsync(src, dest):: [{cmd: 'cp', args: [src, dest]}] }`)
+	cfg, err = config.Parse(cfgp)
+	require.Nil(t, err)
+	assert.Equal(t, []config.Command{{Cmd: "cp", Args: []string{"/a", "/b"}}}, cfg.Backups[0].Commands)
+	assert.Equal(t, "rsync", cfg.Backups[1].Commands[1].Cmd)
+}
+
+func TestNativeFuncs(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "data", "b"), 0o700))
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "data", "a"), 0o700))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "data", "f.txt"), []byte("content"), 0o600))
+	require.Nil(t, os.Setenv("BACKSCHED_TEST_VAR", "set"))
+	defer os.Unsetenv("BACKSCHED_TEST_VAR")
+
+	cfgp := filepath.Join(dir, "config.jsonnet")
+	err := os.WriteFile(cfgp, []byte(`
+local lib = import 'backsched.libsonnet';
+local data = '`+filepath.Join(dir, "data")+`';
+{
+  host: lib.host.name != '' && lib.host.os != '' && lib.host.arch != '',
+  env: [lib.getenv('BACKSCHED_TEST_VAR'), lib.getenv('BACKSCHED_TEST_UNSET', 'def')],
+  exists: [lib.fileExists(data + '/f.txt'), lib.fileExists(data + '/nope'), lib.dirExists(data + '/f.txt')],
+  dirList: lib.dirList(data),
+  glob: [std.strReplace(p, data, '') for p in lib.glob(data + '/*.txt')],
+  readFile: lib.readFile(data + '/f.txt'),
+}`), 0o600)
+	require.Nil(t, err)
+
+	js, err := config.Evaluate(cfgp, config.EvalOpts{})
+	require.Nil(t, err)
+	assert.JSONEq(t, `{
+		"host": true,
+		"env": ["set", "def"],
+		"exists": [true, false, false],
+		"dirList": ["a", "b", "f.txt"],
+		"glob": ["/f.txt"],
+		"readFile": "content"
+	}`, string(js))
+}
+
+func TestEvalOpts(t *testing.T) {
+	require.Nil(t, os.Setenv("BACKSCHED_TEST_DEST", "/mnt/test"))
+	defer os.Unsetenv("BACKSCHED_TEST_DEST")
+
+	env, err := config.ParseEnvAllowlist([]byte(`
+# Destination root.
+BACKSCHED_TEST_DEST
+
+BACKSCHED_TEST_UNSET
+`))
+	require.Nil(t, err)
+	assert.Equal(t, []string{"BACKSCHED_TEST_DEST", "BACKSCHED_TEST_UNSET"}, env)
+	_, err = config.ParseEnvAllowlist([]byte("FOO\nNOT-VALID\n"))
+	assert.NotNil(t, err)
+
+	cfgp := filepath.Join(t.TempDir(), "config.jsonnet")
+	err = os.WriteFile(cfgp, []byte(`
+function(target='prod') {
+  target: target,
+  dest: std.extVar('BACKSCHED_TEST_DEST'),
+  unset: std.extVar('BACKSCHED_TEST_UNSET'),
+  str: std.extVar('str'),
+  code: std.extVar('code'),
+}`), 0o600)
+	require.Nil(t, err)
+
+	js, err := config.Evaluate(cfgp, config.EvalOpts{
+		ExtStrs:  map[string]string{"str": "value"},
+		ExtCodes: map[string]string{"code": "{a: 1 + 1}"},
+		TLAStrs:  map[string]string{"target": "test"},
+		Env:      env,
+	})
+	require.Nil(t, err)
+	assert.JSONEq(t, `{
+		"target": "test",
+		"dest": "/mnt/test",
+		"unset": "",
+		"str": "value",
+		"code": {"a": 2}
+	}`, string(js))
+}
+
+func TestParseIncludes(t *testing.T) {
+	cfg, err := config.Parse("testfiles/include/config.jsonnet")
+	require.Nil(t, err)
+	var names []string
+	for _, b := range cfg.Backups {
+		names = append(names, b.Name)
+	}
+	// The main config first, then the includes in file name order.
+	assert.Equal(t, []string{"main", "first", "second"}, names)
+
+	_, err = config.Parse("testfiles/include-dup/config.jsonnet")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "testfiles/include-dup/config.jsonnet")
+	assert.Contains(t, err.Error(), "testfiles/include-dup/backups.d/dup.yaml")
+}
+
+func TestLoadState(t *testing.T) {
+	// Older versions stored only the time of the last successful backup.
+	state, err := config.LoadState([]byte(`{"old": "2021-03-01T10:00:00Z"}`))
+	require.Nil(t, err)
+	last, ok := state.LastBackupOf("old")
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC), last)
+
+	state.RecordRun("new", config.RunInfo{
+		Start:      last,
+		Duration:   config.Duration(time.Minute),
+		ExitStatus: 2,
+		Error:      "exit status 2",
+	})
+	_, ok = state.LastBackupOf("new")
+	assert.False(t, ok)
+
+	// Round trip.
+	buf, err := state.Save()
+	require.Nil(t, err)
+	state2, err := config.LoadState(buf)
+	require.Nil(t, err)
+	assert.Equal(t, state, state2)
+
+	// Unknown fields are rejected.
+	_, err = config.LoadState([]byte(`{"new": {"lastSuccess": "2021-03-01T10:00:00Z", "foo": 1}}`))
+	assert.NotNil(t, err)
+}
+
+func TestMergeState(t *testing.T) {
+	t0 := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	ours := config.State{
+		"a": {LastSuccess: t0},
+		"b": {LastSuccess: t0.Add(time.Hour)},
+	}
+	theirs := config.State{
+		"a": {LastSuccess: t0.Add(time.Hour)},
+		"b": {LastSuccess: t0},
+		"c": {LastSuccess: t0},
+	}
+	// A failed run is activity too.
+	theirs.RecordRun("b", config.RunInfo{
+		Start:      t0.Add(2 * time.Hour),
+		Duration:   config.Duration(time.Minute),
+		ExitStatus: 1,
+	})
+
+	ours.Merge(theirs)
+	assert.Equal(t, config.State{
+		"a": theirs["a"],
+		"b": theirs["b"],
+		"c": theirs["c"],
+	}, ours)
+}
+
+func TestMergeStateTies(t *testing.T) {
+	t0 := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	stored := config.State{
+		"a": {LastSuccess: t0},
+		"b": {LastSuccess: t0},
+	}
+	// Equally recent: the incoming entry wins, e.g. a checkpoint cleared in
+	// the same instant it was saved.
+	cp := &config.Checkpoint{Start: t0, Updated: t0, Completed: 1}
+	ours := config.State{
+		"a": {LastSuccess: t0, Checkpoint: cp},
+		// Only the checkpoint is more recent.
+		"b": {LastSuccess: t0.Add(-time.Hour), Checkpoint: &config.Checkpoint{
+			Start:     t0,
+			Updated:   t0.Add(time.Minute),
+			Completed: 1,
+		}},
+	}
+	stored.Merge(ours)
+	assert.Equal(t, ours, stored)
+
+	// And the other way around.
+	ours = config.State{"a": {LastSuccess: t0}}
+	stored.Merge(ours)
+	assert.Nil(t, stored["a"].Checkpoint)
+}
+
+func TestCheckpoint(t *testing.T) {
+	t0 := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	cmds := []config.Command{{Cmd: "rsync"}, {Cmd: "restic"}}
+	assert.Equal(t, config.CommandsDigest(cmds), config.CommandsDigest(cmds))
+	assert.NotEqual(t, config.CommandsDigest(cmds), config.CommandsDigest(cmds[:1]))
+
+	state := config.State{}
+	cp := &config.Checkpoint{Start: t0, Updated: t0.Add(time.Hour), Completed: 1}
+	state.SetCheckpoint("a", cp)
+	state.RecordRun("a", config.RunInfo{Start: t0, ExitStatus: 1})
+	assert.Equal(t, cp, state["a"].Checkpoint)
+
+	// A checkpoint is activity too.
+	other := config.State{"a": {LastSuccess: t0.Add(time.Minute)}}
+	other.Merge(state)
+	assert.Equal(t, cp, other["a"].Checkpoint)
+
+	// A successful run completes the checkpoint.
+	state.RecordRun("a", config.RunInfo{Start: t0.Add(2 * time.Hour)})
+	assert.Nil(t, state["a"].Checkpoint)
+}
+
+func TestRunsOn(t *testing.T) {
+	host := config.Host{Name: "Laptop-1.home.lan", OS: "linux", Arch: "amd64"}
+	cases := []struct {
+		name      string
+		hosts     []string
+		platforms []string
+		expected  bool
+	}{
+		{name: "unconstrained", expected: true},
+		{name: "short name", hosts: []string{"server", "laptop-1"}, expected: true},
+		{name: "full name", hosts: []string{"laptop-1.home.lan"}, expected: true},
+		{name: "glob", hosts: []string{"laptop-*"}, expected: true},
+		{name: "other host", hosts: []string{"server"}, expected: false},
+		{name: "os", platforms: []string{"darwin", "linux"}, expected: true},
+		{name: "os arch", platforms: []string{"linux/arm*"}, expected: false},
+		{name: "host and platform", hosts: []string{"laptop-*"}, platforms: []string{"windows"}, expected: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := config.Backup{Hosts: tc.hosts, Platforms: tc.platforms}
+			assert.Equal(t, tc.expected, b.RunsOn(host))
+		})
+	}
+}
+
+func TestEditState(t *testing.T) {
+	t0 := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Hour)
+	state := config.State{}
+	state.RecordRun("a", config.RunInfo{Start: t0})
+	state.RecordRun(config.VerifyStateKey("a"), config.RunInfo{Start: t0})
+	state.MarkSuccess("b", t0, t1)
+
+	state.Reset("a", t1)
+	_, ok := state.LastBackupOf("a")
+	assert.False(t, ok)
+	assert.Len(t, state["a"].Runs, 1)
+
+	require.Nil(t, state.Rename("a", "c", t1))
+	assert.Error(t, state.Rename("a", "d", t1))
+	assert.Error(t, state.Rename("b", "c", t1))
+	assert.Len(t, state["c"].Runs, 1)
+	assert.Len(t, state[config.VerifyStateKey("c")].Runs, 1)
+	// The old name can be reused.
+	state.RecordRun("a", config.RunInfo{Start: t1})
+	assert.Nil(t, state["a"].Deleted)
+
+	removed := state.Prune([]string{"c"}, t1)
+	assert.Equal(t, []string{"a", "b"}, removed)
+	// Removed entries are kept as tombstones for a while.
+	assert.Equal(t, []string{"a", "a:verify", "b", "c", "c:verify"}, stateKeys(state))
+	_, ok = state.LastBackupOf("b")
+	assert.False(t, ok)
+	assert.Empty(t, state.Prune([]string{"c"}, t1.Add(time.Hour)))
+	assert.Len(t, state, 5)
+	assert.Empty(t, state.Prune([]string{"c"}, t1.Add(8*24*time.Hour)))
+	assert.Equal(t, []string{"c", "c:verify"}, stateKeys(state))
+}
+
+func TestMergeEdits(t *testing.T) {
+	t0 := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	// Another machine loaded the state before the edits.
+	old := config.State{}
+	old.RecordRun("a", config.RunInfo{Start: t0})
+	old.RecordRun("b", config.RunInfo{Start: t0})
+
+	edited := config.State{}
+	edited.Merge(old)
+	edited.Reset("a", t0.Add(time.Hour))
+	edited.Prune([]string{"a"}, t0.Add(time.Hour))
+
+	// The edits survive merging the old copy.
+	edited.Merge(old)
+	_, ok := edited.LastBackupOf("a")
+	assert.False(t, ok)
+	_, ok = edited.LastBackupOf("b")
+	assert.False(t, ok)
+	assert.NotNil(t, edited["b"].Deleted)
+
+	// Newer runs win over the edits.
+	newer := config.State{}
+	newer.RecordRun("b", config.RunInfo{Start: t0.Add(2 * time.Hour)})
+	edited.Merge(newer)
+	_, ok = edited.LastBackupOf("b")
+	assert.True(t, ok)
+}
+
+func stateKeys(s config.State) []string {
+	var res []string
+	for k := range s {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestEncryptedValues(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	require.Nil(t, err)
+	ids, err := config.ParseIdentities([]byte("# comment\n" + id.String() + "\n"))
+	require.Nil(t, err)
+	ct, err := config.Encrypt("https://hc-ping.com/token", []age.Recipient{id.Recipient()})
+	require.Nil(t, err)
+
+	// Same format as `backsched secret encrypt`.
+	var block strings.Builder
+	for _, line := range strings.Split(strings.TrimSpace(ct), "\n") {
+		block.WriteString("        " + line + "\n")
+	}
+	cfgp := filepath.Join(t.TempDir(), "config.jsonnet")
+	err = os.WriteFile(cfgp, []byte(`
+local bs = import 'backsched.libsonnet';
+{
+  version: 'v1alpha1',
+  backups: [{
+    name: 'b1',
+    interval: '1h',
+    commands: [{ cmd: 'true' }],
+    heartbeat: {
+      success: bs.decrypt(|||
+`+block.String()+`      |||),
+    },
+  }],
+}`), 0o600)
+	require.Nil(t, err)
+
+	cfg, err := config.ParseWith(cfgp, config.EvalOpts{Identities: ids})
+	require.Nil(t, err)
+	assert.Equal(t, "https://hc-ping.com/token", cfg.Backups[0].Heartbeat.Success)
+
+	// Redacted.
+	cfg, err = config.ParseWith(cfgp, config.EvalOpts{Redact: true})
+	require.Nil(t, err)
+	assert.Equal(t, config.RedactedValue, cfg.Backups[0].Heartbeat.Success)
+
+	// The identity is required.
+	_, err = config.ParseWith(cfgp, config.EvalOpts{})
+	assert.Error(t, err)
+	other, err := age.GenerateX25519Identity()
+	require.Nil(t, err)
+	_, err = config.ParseWith(cfgp, config.EvalOpts{Identities: []age.Identity{other}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/google/go-jsonnet"
+	"github.com/google/go-jsonnet/ast"
+)
+
+// RedactedValue replaces the encrypted values when the config is evaluated
+// with EvalOpts.Redact.
+const RedactedValue = "<encrypted>"
+
+// decryptFunc returns the `decrypt` native function, decrypting age
+// encrypted values with the identities in the options.
+func decryptFunc(opts EvalOpts) *jsonnet.NativeFunction {
+	return &jsonnet.NativeFunction{
+		Name:   "decrypt",
+		Params: ast.Identifiers{"ciphertext"},
+		Func: func(args []interface{}) (interface{}, error) {
+			ct, err := stringArg(args, 0)
+			if err != nil {
+				return nil, err
+			}
+			if opts.Redact {
+				return RedactedValue, nil
+			}
+			return Decrypt(ct, opts.Identities)
+		},
+	}
+}
+
+// Decrypt decrypts an armored age ciphertext.
+func Decrypt(ciphertext string, ids []age.Identity) (string, error) {
+	if len(ids) == 0 {
+		return "", errors.New("decrypt: no identity available")
+	}
+	r, err := age.Decrypt(armor.NewReader(strings.NewReader(strings.TrimSpace(ciphertext))), ids...)
+	if err != nil {
+		return "", fmt.Errorf("decrypt: %w", err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("decrypt: %w", err)
+	}
+	return string(b), nil
+}
+
+// Encrypt encrypts a value for the given recipients, returning an armored
+// ciphertext that can be passed to `decrypt` in the config.
+func Encrypt(plaintext string, rs []age.Recipient) (string, error) {
+	var buf bytes.Buffer
+	aw := armor.NewWriter(&buf)
+	w, err := age.Encrypt(aw, rs...)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(w, plaintext); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if err := aw.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ParseIdentities parses an age identity file.
+func ParseIdentities(buf []byte) ([]age.Identity, error) {
+	return age.ParseIdentities(bytes.NewReader(buf))
+}
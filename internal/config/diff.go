@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// unifiedDiff returns a line-based diff between a and b, in a format
+// similar to `diff -u`, without hunk headers.
+func unifiedDiff(nameA, nameB, a, b string) string {
+	la := strings.Split(a, "\n")
+	lb := strings.Split(b, "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// la[i:] and lb[j:].
+	lcs := make([][]int, len(la)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(lb)+1)
+	}
+	for i := len(la) - 1; i >= 0; i-- {
+		for j := len(lb) - 1; j >= 0; j-- {
+			switch {
+			case la[i] == lb[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+	i, j := 0, 0
+	for i < len(la) || j < len(lb) {
+		switch {
+		case i < len(la) && j < len(lb) && la[i] == lb[j]:
+			fmt.Fprintf(&sb, " %s\n", la[i])
+			i++
+			j++
+		case i < len(la) && (j == len(lb) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&sb, "-%s\n", la[i])
+			i++
+		default:
+			fmt.Fprintf(&sb, "+%s\n", lb[j])
+			j++
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,29 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ParseEnvAllowlist parses a list of environment variable names, one per
+// line. Empty lines and lines starting with '#' are ignored.
+func ParseEnvAllowlist(buf []byte) ([]string, error) {
+	var res []string
+	sc := bufio.NewScanner(bytes.NewReader(buf))
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !envNameRe.MatchString(line) {
+			return nil, fmt.Errorf("line %d: invalid environment variable name %q", lineno, line)
+		}
+		res = append(res, line)
+	}
+	return res, sc.Err()
+}
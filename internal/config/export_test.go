@@ -0,0 +1,10 @@
+package config
+
+// SetMigrations replaces the migration chain for the duration of a test.
+//
+// The returned function restores the original chain.
+func SetMigrations(from string, upgrade func(map[string]interface{}) error) func() {
+	old := migrations
+	migrations = []migration{{From: from, To: Version, Upgrade: upgrade}}
+	return func() { migrations = old }
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Extensions lists the supported config file extensions, in order of
+// preference.
+var Extensions = []string{".jsonnet", ".yaml", ".yml", ".json"}
+
+// IncludeDir is the directory, next to the main config file, where
+// additional config files can be dropped in. Each of them contributes
+// backups to the main config.
+const IncludeDir = "backups.d"
+
+// includeFiles returns the config files in the given include directory,
+// sorted by name. Hidden files and files with unsupported extensions are
+// ignored.
+func includeFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading include dir: %w", err)
+	}
+	var res []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || !isConfigExt(filepath.Ext(e.Name())) {
+			continue
+		}
+		res = append(res, filepath.Join(dir, e.Name()))
+	}
+	// ReadDir already sorts by name.
+	return res, nil
+}
+
+func isConfigExt(ext string) bool {
+	for _, e := range Extensions {
+		if strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func readJSON(path string) ([]byte, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Make sure syntax errors are reported with their context.
+	var v interface{}
+	if err := jsonUnmarshalStrict(buf, &v); err != nil {
+		return nil, fmt.Errorf("json unmarshal: %w", err)
+	}
+	return buf, nil
+}
+
+func readYAML(path string) ([]byte, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := yaml.Unmarshal(buf, &v); err != nil {
+		return nil, fmt.Errorf("yaml unmarshal: %w", err)
+	}
+	v, err = yamlToJSONValue(v, "")
+	if err != nil {
+		return nil, fmt.Errorf("yaml unmarshal: %w", err)
+	}
+	return json.Marshal(v)
+}
+
+// yamlToJSONValue converts a value decoded from YAML into one that can be
+// represented in JSON.
+func yamlToJSONValue(v interface{}, path string) (interface{}, error) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, item := range value {
+			conv, err := yamlToJSONValue(item, path+"/"+escapePointer(k))
+			if err != nil {
+				return nil, err
+			}
+			value[k] = conv
+		}
+		return value, nil
+	case map[interface{}]interface{}:
+		res := map[string]interface{}{}
+		for k, item := range value {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, SchemaError{Path: path, Msg: fmt.Sprintf("non-string key %v", k)}
+			}
+			conv, err := yamlToJSONValue(item, path+"/"+escapePointer(ks))
+			if err != nil {
+				return nil, err
+			}
+			res[ks] = conv
+		}
+		return res, nil
+	case []interface{}:
+		for i, item := range value {
+			conv, err := yamlToJSONValue(item, fmt.Sprintf("%s/%d", path, i))
+			if err != nil {
+				return nil, err
+			}
+			value[i] = conv
+		}
+		return value, nil
+	default:
+		return value, nil
+	}
+}
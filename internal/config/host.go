@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// Host identifies the machine backups run on.
+type Host struct {
+	// Name is the hostname.
+	Name string `json:"name"`
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+}
+
+// CurrentHost returns the host the program is running on.
+func CurrentHost() (Host, error) {
+	name, err := os.Hostname()
+	if err != nil {
+		return Host{}, fmt.Errorf("getting hostname: %w", err)
+	}
+	return Host{Name: name, OS: runtime.GOOS, Arch: runtime.GOARCH}, nil
+}
+
+// RunsOn returns true if the backup is meant for the given host.
+//
+// A backup without hosts and platforms runs everywhere. Host names are
+// matched case insensitively, both in their full and short form (i.e.
+// without the domain).
+func (b Backup) RunsOn(h Host) bool {
+	return b.matchesHost(h.Name) && b.matchesPlatform(h.OS, h.Arch)
+}
+
+func (b Backup) matchesHost(name string) bool {
+	if len(b.Hosts) == 0 {
+		return true
+	}
+	name = strings.ToLower(name)
+	short := strings.SplitN(name, ".", 2)[0]
+	for _, p := range b.Hosts {
+		p = strings.ToLower(p)
+		if globMatch(p, name) || globMatch(p, short) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b Backup) matchesPlatform(goos, arch string) bool {
+	if len(b.Platforms) == 0 {
+		return true
+	}
+	for _, p := range b.Platforms {
+		parts := strings.SplitN(p, "/", 2)
+		if !globMatch(parts[0], goos) {
+			continue
+		}
+		if len(parts) == 1 || globMatch(parts[1], arch) {
+			return true
+		}
+	}
+	return false
+}
+
+func globMatch(pattern, s string) bool {
+	// Patterns are validated when parsing the config.
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
+
+func checkHosts(b Backup) error {
+	for _, p := range b.Hosts {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid host pattern %q: %w", p, err)
+		}
+	}
+	for _, p := range b.Platforms {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid platform pattern %q: %w", p, err)
+		}
+		if strings.Count(p, "/") > 1 {
+			return fmt.Errorf("invalid platform %q: expected os or os/arch", p)
+		}
+	}
+	return nil
+}
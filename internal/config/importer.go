@@ -0,0 +1,56 @@
+package config
+
+import (
+	"embed"
+
+	"github.com/google/go-jsonnet"
+)
+
+//go:embed lib/*.libsonnet
+var libFS embed.FS
+
+// bundledPrefix marks import locations resolved to the bundled libraries.
+const bundledPrefix = "<bundled>/"
+
+// bundledLibs maps import paths to the libraries bundled in the binary.
+//
+// The unversioned path always points to the latest version.
+var bundledLibs = map[string]string{
+	"backsched.libsonnet":    "lib/v1.libsonnet",
+	"backsched/v1.libsonnet": "lib/v1.libsonnet",
+}
+
+// bundledImporter resolves imports on the filesystem first, falling back to
+// the bundled libraries. This way a local file with the same name of a
+// bundled library overrides it.
+type bundledImporter struct {
+	fs    jsonnet.FileImporter
+	cache map[string]jsonnet.Contents
+}
+
+func newBundledImporter() *bundledImporter {
+	return &bundledImporter{cache: map[string]jsonnet.Contents{}}
+}
+
+// Import implements jsonnet.Importer.
+func (b *bundledImporter) Import(importedFrom, importedPath string) (jsonnet.Contents, string, error) {
+	contents, foundAt, err := b.fs.Import(importedFrom, importedPath)
+	if err == nil {
+		return contents, foundAt, nil
+	}
+	p, ok := bundledLibs[importedPath]
+	if !ok {
+		return contents, foundAt, err
+	}
+	foundAt = bundledPrefix + importedPath
+	if c, ok := b.cache[p]; ok {
+		return c, foundAt, nil
+	}
+	buf, rerr := libFS.ReadFile(p)
+	if rerr != nil {
+		return jsonnet.Contents{}, "", rerr
+	}
+	c := jsonnet.MakeContents(string(buf))
+	b.cache[p] = c
+	return c, foundAt, nil
+}
@@ -15,6 +15,34 @@ local hasFields(o, fs) =
     USER: std.extVar('USER'),
   },
 
+  // host contains information about the machine evaluating the config.
+  host: {
+    name: std.native('hostname')(),
+    os: std.native('os')(),
+    arch: std.native('arch')(),
+  },
+
+  // env lookup.
+  //
+  // Returns the value of an environment variable, or the given default if
+  // the variable is not set.
+  getenv(name, default=null):: std.native('env')(name, default),
+
+  // filesystem helpers.
+  //
+  // These are evaluated on the local machine when the config is parsed.
+  fileExists(path):: std.native('fileExists')(path),
+  dirExists(path):: std.native('dirExists')(path),
+  dirList(path):: std.native('dirList')(path),
+  glob(pattern):: std.native('glob')(pattern),
+  readFile(path):: std.native('readFile')(path),
+
+  // encrypted values.
+  //
+  // Decrypts a value encrypted with `backsched secret encrypt`, using the
+  // local identity file.
+  decrypt(ciphertext):: std.native('decrypt')(ciphertext),
+
   // rsync.
   //
   // Uses rsync to backup a source to a destination directory.
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// migration upgrades a config document from a version to the following one.
+type migration struct {
+	From string
+	To   string
+	// Upgrade modifies the document in place. The version field is updated
+	// automatically.
+	Upgrade func(doc map[string]interface{}) error
+}
+
+// migrations is the chain of known upgrades, from the oldest version to the
+// latest. The last migration must have To == Version.
+var migrations []migration
+
+// Migrate upgrades an evaluated config document to the latest version.
+//
+// It returns the version the document was originally in, and the upgraded
+// document. If the document is already at the latest version, it is returned
+// unchanged.
+func Migrate(buf []byte) (string, []byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(buf, &doc); err != nil {
+		return "", nil, fmt.Errorf("json unmarshal: %w", err)
+	}
+	from, _ := doc["version"].(string)
+	if from == Version {
+		return from, buf, nil
+	}
+
+	i := migrationFrom(from)
+	if i < 0 {
+		return from, nil, fmt.Errorf("unknown version %q, expected %q", from, Version)
+	}
+	for _, m := range migrations[i:] {
+		if err := m.Upgrade(doc); err != nil {
+			return from, nil, fmt.Errorf("migrating from %q to %q: %w", m.From, m.To, err)
+		}
+		doc["version"] = m.To
+	}
+
+	res, err := json.Marshal(doc)
+	return from, res, err
+}
+
+// FileMigration is the result of migrating a config file.
+type FileMigration struct {
+	// From is the version the config was originally in.
+	From string
+	// Before and After are the evaluated config, indented, before and after
+	// the migration.
+	Before string
+	After  string
+	// Encrypted is true when the config contains encrypted values. They are
+	// redacted in Before and After.
+	Encrypted bool
+}
+
+// MigrateFile evaluates the config in the given path and migrates it to the
+// latest version. Encrypted values are never decrypted.
+func MigrateFile(path string, opts EvalOpts) (FileMigration, error) {
+	var res FileMigration
+	opts.Redact = true
+	js, err := Evaluate(path, opts)
+	if err != nil {
+		return res, fmt.Errorf("evaluating config %q: %w", path, err)
+	}
+	from, migrated, err := Migrate(js)
+	if err != nil {
+		return res, fmt.Errorf("migrating config %q: %w", path, err)
+	}
+	// Make sure the result is a valid config.
+	if _, err := Decode(migrated); err != nil {
+		return res, fmt.Errorf("decoding migrated config: %w", err)
+	}
+
+	res.From = from
+	var doc interface{}
+	if res.Before, err = indentJSON(js, &doc); err != nil {
+		return res, err
+	}
+	res.Encrypted = containsString(doc, RedactedValue)
+	res.After, err = indentJSON(migrated, &doc)
+	return res, err
+}
+
+// Diff returns a line-based diff between the config before and after the
+// migration.
+func (m FileMigration) Diff() string {
+	return unifiedDiff(m.From, Version,
+		strings.TrimSuffix(m.Before, "\n"), strings.TrimSuffix(m.After, "\n"))
+}
+
+// indentJSON decodes the JSON document into v and encodes it back indented,
+// so that documents encoded differently compare equal.
+func indentJSON(js []byte, v *interface{}) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return "", fmt.Errorf("json unmarshal: %w", err)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(*v); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// containsString returns true if s is a string value in the decoded JSON
+// document v.
+func containsString(v interface{}, s string) bool {
+	switch t := v.(type) {
+	case string:
+		return t == s
+	case []interface{}:
+		for _, e := range t {
+			if containsString(e, s) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, e := range t {
+			if containsString(e, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// KnownVersions returns all the config versions that can be decoded, from
+// the oldest to the latest.
+func KnownVersions() []string {
+	var res []string
+	for _, m := range migrations {
+		res = append(res, m.From)
+	}
+	return append(res, Version)
+}
+
+func migrationFrom(version string) int {
+	for i, m := range migrations {
+		if m.From == version {
+			return i
+		}
+	}
+	return -1
+}
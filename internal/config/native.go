@@ -0,0 +1,145 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"github.com/google/go-jsonnet"
+	"github.com/google/go-jsonnet/ast"
+)
+
+// nativeFuncs are the functions available to the config through
+// `std.native(name)`. They allow a config shared across machines to adapt to
+// the host it's evaluated on.
+var nativeFuncs = []*jsonnet.NativeFunction{
+	{
+		Name: "hostname",
+		Func: func([]interface{}) (interface{}, error) {
+			return os.Hostname()
+		},
+	},
+	{
+		Name: "os",
+		Func: func([]interface{}) (interface{}, error) {
+			return runtime.GOOS, nil
+		},
+	},
+	{
+		Name: "arch",
+		Func: func([]interface{}) (interface{}, error) {
+			return runtime.GOARCH, nil
+		},
+	},
+	{
+		Name:   "env",
+		Params: ast.Identifiers{"name", "default"},
+		Func: func(args []interface{}) (interface{}, error) {
+			name, err := stringArg(args, 0)
+			if err != nil {
+				return nil, err
+			}
+			if v, ok := os.LookupEnv(name); ok {
+				return v, nil
+			}
+			return args[1], nil
+		},
+	},
+	{
+		Name:   "fileExists",
+		Params: ast.Identifiers{"path"},
+		Func: func(args []interface{}) (interface{}, error) {
+			p, err := stringArg(args, 0)
+			if err != nil {
+				return nil, err
+			}
+			_, err = os.Stat(p)
+			return err == nil, nil
+		},
+	},
+	{
+		Name:   "dirExists",
+		Params: ast.Identifiers{"path"},
+		Func: func(args []interface{}) (interface{}, error) {
+			p, err := stringArg(args, 0)
+			if err != nil {
+				return nil, err
+			}
+			fi, err := os.Stat(p)
+			return err == nil && fi.IsDir(), nil
+		},
+	},
+	{
+		Name:   "dirList",
+		Params: ast.Identifiers{"path"},
+		Func: func(args []interface{}) (interface{}, error) {
+			p, err := stringArg(args, 0)
+			if err != nil {
+				return nil, err
+			}
+			entries, err := os.ReadDir(p)
+			if err != nil {
+				return nil, err
+			}
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			return toJsonnetList(names), nil
+		},
+	},
+	{
+		Name:   "glob",
+		Params: ast.Identifiers{"pattern"},
+		Func: func(args []interface{}) (interface{}, error) {
+			p, err := stringArg(args, 0)
+			if err != nil {
+				return nil, err
+			}
+			matches, err := filepath.Glob(p)
+			if err != nil {
+				return nil, err
+			}
+			return toJsonnetList(matches), nil
+		},
+	},
+	{
+		Name:   "readFile",
+		Params: ast.Identifiers{"path"},
+		Func: func(args []interface{}) (interface{}, error) {
+			p, err := stringArg(args, 0)
+			if err != nil {
+				return nil, err
+			}
+			b, err := os.ReadFile(p)
+			return string(b), err
+		},
+	},
+}
+
+func registerNativeFuncs(vm *jsonnet.VM) {
+	for _, f := range nativeFuncs {
+		vm.NativeFunction(f)
+	}
+}
+
+func stringArg(args []interface{}, i int) (string, error) {
+	s, ok := args[i].(string)
+	if !ok {
+		return "", fmt.Errorf("argument %d: expected string, got %T", i, args[i])
+	}
+	return s, nil
+}
+
+// toJsonnetList converts a list of strings into a sorted list that can be
+// returned to the Jsonnet VM.
+func toJsonnetList(ss []string) []interface{} {
+	sort.Strings(ss)
+	res := make([]interface{}, len(ss))
+	for i, s := range ss {
+		res[i] = s
+	}
+	return res
+}
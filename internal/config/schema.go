@@ -0,0 +1,330 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// schemaDraft is the JSON Schema dialect generated by JSONSchema.
+const schemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// durationPattern matches the strings accepted by time.ParseDuration.
+const durationPattern = `^[-+]?(0|(([0-9]+(\.[0-9]*)?|\.[0-9]+)(ns|us|µs|μs|ms|s|m|h))+)$`
+
+// durationRe is durationPattern, compiled once.
+var durationRe = regexp.MustCompile(durationPattern)
+
+// defsPrefix is the prefix of the references to the shared definitions.
+const defsPrefix = "#/$defs/"
+
+// Schema is a subset of a JSON Schema document, enough to describe the
+// config format.
+type Schema struct {
+	Schema string `json:"$schema,omitempty"`
+	// Ref points to a schema in Defs of the root document.
+	Ref         string `json:"$ref,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Type        string `json:"type,omitempty"`
+	// Properties describes the fields of an object.
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	// Required lists the properties that must be present in an object.
+	Required []string `json:"required,omitempty"`
+	// AdditionalProperties is either a bool or a *Schema.
+	AdditionalProperties interface{} `json:"additionalProperties,omitempty"`
+	// Items is the schema of every element of an array.
+	Items   *Schema   `json:"items,omitempty"`
+	AnyOf   []*Schema `json:"anyOf,omitempty"`
+	Pattern string    `json:"pattern,omitempty"`
+	// Defs contains the schemas shared by multiple properties, referenced
+	// with Ref.
+	Defs map[string]*Schema `json:"$defs,omitempty"`
+
+	// re is Pattern, compiled.
+	re *regexp.Regexp
+}
+
+// JSONSchema returns the JSON Schema describing the config format.
+//
+// Every named type except the top level one is emitted once in the shared
+// definitions and referenced where used.
+func JSONSchema() *Schema {
+	g := schemaGen{defs: map[string]*Schema{}}
+	s := g.structSchema(reflect.TypeOf(Config{}))
+	s.Schema = schemaDraft
+	s.Title = "backsched config"
+	s.Defs = g.defs
+	return s
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// schemaGen generates schemas from types, collecting the shared definitions.
+type schemaGen struct {
+	defs map[string]*Schema
+}
+
+func (g schemaGen) schemaOf(t reflect.Type) *Schema {
+	if t.Name() != "" && (t == durationType || t.Kind() == reflect.Struct) {
+		return g.ref(t)
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schemaOf(t.Elem())
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		return g.structSchema(t)
+	default:
+		panic(fmt.Sprintf("unsupported type %v in config schema", t))
+	}
+}
+
+// ref returns a reference to the definition of the named type t, adding it
+// to the definitions if needed.
+func (g schemaGen) ref(t reflect.Type) *Schema {
+	name := t.Name()
+	if _, ok := g.defs[name]; !ok {
+		// Reserve the name before recursing, in case of recursive types.
+		g.defs[name] = nil
+		if t == durationType {
+			g.defs[name] = &Schema{
+				Description: "A duration, either as a string (e.g. '24h') or in nanoseconds.",
+				AnyOf: []*Schema{
+					{Type: "string", Pattern: durationPattern, re: durationRe},
+					{Type: "number"},
+				},
+			}
+		} else {
+			g.defs[name] = g.structSchema(t)
+		}
+	}
+	return &Schema{Ref: defsPrefix + name}
+}
+
+func (g schemaGen) structSchema(t reflect.Type) *Schema {
+	res := &Schema{
+		Type:                 "object",
+		Properties:           map[string]*Schema{},
+		AdditionalProperties: false,
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// Unexported.
+			continue
+		}
+		name, opts := parseJSONTag(f)
+		if name == "-" {
+			continue
+		}
+		res.Properties[name] = g.schemaOf(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+			res.Required = append(res.Required, name)
+		}
+	}
+	return res
+}
+
+func parseJSONTag(f reflect.StructField) (name, opts string) {
+	tag := f.Tag.Get("json")
+	name = tag
+	if i := strings.Index(tag, ","); i >= 0 {
+		name, opts = tag[:i], tag[i+1:]
+	}
+	if name == "" {
+		name = f.Name
+	}
+	return name, opts
+}
+
+// SchemaError is a violation of the schema at a specific location.
+type SchemaError struct {
+	// Path is the JSON pointer (RFC 6901) to the offending value.
+	Path string
+	Msg  string
+}
+
+func (e SchemaError) Error() string {
+	p := e.Path
+	if p == "" {
+		p = "/"
+	}
+	return fmt.Sprintf("%s: %s", p, e.Msg)
+}
+
+// Validate checks a JSON document against the schema and returns all the
+// violations found, ordered by path.
+func (s *Schema) Validate(buf []byte) ([]SchemaError, error) {
+	var v interface{}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return nil, err
+	}
+	var errs []SchemaError
+	s.validate(s, v, "", &errs)
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Path < errs[j].Path
+	})
+	return errs, nil
+}
+
+func (s *Schema) validate(root *Schema, v interface{}, path string, errs *[]SchemaError) {
+	addErr := func(format string, a ...interface{}) {
+		*errs = append(*errs, SchemaError{Path: path, Msg: fmt.Sprintf(format, a...)})
+	}
+
+	if s.Ref != "" {
+		def := root.Defs[strings.TrimPrefix(s.Ref, defsPrefix)]
+		if def == nil || !strings.HasPrefix(s.Ref, defsPrefix) {
+			addErr("unresolved schema reference %q", s.Ref)
+			return
+		}
+		def.validate(root, v, path, errs)
+		return
+	}
+
+	if len(s.AnyOf) > 0 {
+		for _, alt := range s.AnyOf {
+			var tmp []SchemaError
+			alt.validate(root, v, path, &tmp)
+			if len(tmp) == 0 {
+				return
+			}
+		}
+		if s.Description != "" {
+			addErr("invalid value %s: expected %s", shortJSON(v), lowerFirst(s.Description))
+		} else {
+			addErr("invalid value %s", shortJSON(v))
+		}
+		return
+	}
+
+	if s.Type != "" && !hasType(v, s.Type) {
+		addErr("expected %s, got %s", s.Type, typeName(v))
+		return
+	}
+	if s.Pattern != "" {
+		if str, ok := v.(string); ok && !s.patternRe().MatchString(str) {
+			addErr("invalid value %q", str)
+		}
+	}
+
+	switch value := v.(type) {
+	case []interface{}:
+		if s.Items == nil {
+			return
+		}
+		for i, item := range value {
+			s.Items.validate(root, item, fmt.Sprintf("%s/%d", path, i), errs)
+		}
+	case map[string]interface{}:
+		for _, r := range s.Required {
+			if _, ok := value[r]; !ok {
+				addErr("missing required field %q", r)
+			}
+		}
+		for k, item := range value {
+			p := path + "/" + escapePointer(k)
+			if ps, ok := s.Properties[k]; ok {
+				ps.validate(root, item, p, errs)
+				continue
+			}
+			switch ap := s.AdditionalProperties.(type) {
+			case *Schema:
+				ap.validate(root, item, p, errs)
+			case bool:
+				if !ap {
+					*errs = append(*errs, SchemaError{Path: p, Msg: "unknown field"})
+				}
+			}
+		}
+	}
+}
+
+// patternRe returns the compiled Pattern. Generated schemas have it compiled
+// already.
+func (s *Schema) patternRe() *regexp.Regexp {
+	if s.re == nil {
+		s.re = regexp.MustCompile(s.Pattern)
+	}
+	return s.re
+}
+
+func hasType(v interface{}, typ string) bool {
+	switch typ {
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == float64(int64(f))
+	}
+	return false
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func shortJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil || len(b) > 40 {
+		return typeName(v)
+	}
+	return string(b)
+}
+
+func lowerFirst(s string) string {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+// escapePointer escapes a JSON pointer reference token.
+func escapePointer(s string) string {
+	s = strings.ReplaceAll(s, "~", "~0")
+	return strings.ReplaceAll(s, "/", "~1")
+}
@@ -1,7 +1,11 @@
 package config
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
+	"sort"
 	"time"
 )
 
@@ -13,17 +17,266 @@ func LoadState(b []byte) (State, error) {
 }
 
 // State contains the state of all the backups
-type State map[string]time.Time
+type State map[string]BackupState
+
+// MaxRuns is the number of runs kept in the history of each backup.
+const MaxRuns = 20
+
+// BackupState is the state of a single backup.
+type BackupState struct {
+	// LastSuccess is the time of the last successful run.
+	LastSuccess time.Time `json:"lastSuccess"`
+	// Runs contains the outcome of the latest runs, successful or not, most
+	// recent first. At most MaxRuns are kept.
+	Runs []RunInfo `json:"runs,omitempty"`
+	// Checkpoint tracks the progress of the last incomplete run, if any.
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+	// Modified is the time of the last manual edit of the state, e.g. a
+	// reset, so that the edit wins when merging with older copies.
+	Modified *time.Time `json:"modified,omitempty"`
+	// Deleted is set when the state was removed, e.g. by a prune. The entry
+	// is kept as a tombstone, so the removal wins when merging with older
+	// copies.
+	Deleted *time.Time `json:"deleted,omitempty"`
+}
+
+// tombstoneTTL is how long deleted entries are kept. It only needs to be
+// longer than any run, whose state may still contain the entry.
+const tombstoneTTL = 7 * 24 * time.Hour
+
+// Checkpoint records how many commands of a run completed successfully.
+type Checkpoint struct {
+	// Start is the time the run started.
+	Start time.Time `json:"start"`
+	// Updated is the time the last command completed.
+	Updated time.Time `json:"updated"`
+	// Completed is the number of commands completed, in order.
+	Completed int `json:"completed"`
+	// Digest identifies the commands of the run. A checkpoint can only be
+	// resumed if the commands didn't change in the meantime.
+	Digest string `json:"digest"`
+}
+
+// CommandsDigest returns a digest identifying a list of commands, to be used
+// in checkpoints.
+func CommandsDigest(cmds []Command) string {
+	buf, err := json.Marshal(cmds)
+	if err != nil {
+		// Commands are always serializable.
+		panic(err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(buf))
+}
+
+// LastRun returns the outcome of the last run, or nil if the backup never
+// ran.
+func (s BackupState) LastRun() *RunInfo {
+	if len(s.Runs) == 0 {
+		return nil
+	}
+	return &s.Runs[0]
+}
+
+// RunInfo describes the outcome of a backup run.
+type RunInfo struct {
+	// Start is the time the run started.
+	Start time.Time `json:"start"`
+	// Duration is how long the run took.
+	Duration Duration `json:"duration"`
+	// ExitStatus is the exit status of the failing command, zero on success
+	// and -1 if the failure wasn't caused by a command exit status.
+	ExitStatus int `json:"exitStatus"`
+	// Error is the reason of the failure, if any.
+	Error string `json:"error,omitempty"`
+	// Interrupted is true when the run was stopped by a signal before
+	// completing.
+	Interrupted bool `json:"interrupted,omitempty"`
+	// RequirementLost is true when the run was aborted because one of the
+	// requirements stopped being satisfied.
+	RequirementLost bool `json:"requirementLost,omitempty"`
+}
+
+// UnmarshalJSON provides strict JSON unmarshalling for BackupState.
+//
+// For compatibility with older versions, a plain timestamp is accepted as
+// the time of the last successful backup.
+func (s *BackupState) UnmarshalJSON(b []byte) error {
+	var t time.Time
+	if err := json.Unmarshal(b, &t); err == nil {
+		*s = BackupState{LastSuccess: t}
+		return nil
+	}
+	// Avoid recursion by using a type without methods.
+	type plain BackupState
+	var res plain
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&res); err != nil {
+		return err
+	}
+	*s = BackupState(res)
+	return nil
+}
 
 // LastBackupOf returns the time of the last given backup name.
 // Returns false if the backup has been never done
 func (s State) LastBackupOf(name string) (time.Time, bool) {
-	if t, ok := s[name]; ok {
-		return t, true
+	if bs, ok := s[name]; ok && !bs.LastSuccess.IsZero() {
+		return bs.LastSuccess, true
 	}
 	return time.Time{}, false
 }
 
+// RecordRun records the outcome of a run of the given backup. The last
+// success time is updated only if the run succeeded.
+func (s State) RecordRun(name string, run RunInfo) {
+	bs := s.get(name)
+	if run.ExitStatus == 0 && run.Error == "" {
+		bs.LastSuccess = run.Start.Add(time.Duration(run.Duration))
+		bs.Checkpoint = nil
+	}
+	bs.Runs = append([]RunInfo{run}, bs.Runs...)
+	if len(bs.Runs) > MaxRuns {
+		bs.Runs = bs.Runs[:MaxRuns]
+	}
+	s[name] = bs
+}
+
+// SetCheckpoint records the progress of the current run of the given backup.
+// A nil checkpoint removes it.
+func (s State) SetCheckpoint(name string, cp *Checkpoint) {
+	bs := s.get(name)
+	bs.Checkpoint = cp
+	s[name] = bs
+}
+
+// MarkSuccess records a successful backup at the given time, without adding
+// a run to the history. The edit happens at time now.
+func (s State) MarkSuccess(name string, t, now time.Time) {
+	bs := s.get(name)
+	bs.LastSuccess = t
+	bs.Checkpoint = nil
+	bs.Modified = &now
+	s[name] = bs
+}
+
+// Reset forgets the last successful backup, as if it was never done. The run
+// history is kept. The edit happens at time now.
+func (s State) Reset(name string, now time.Time) {
+	if bs, ok := s.lookup(name); ok {
+		bs.LastSuccess = time.Time{}
+		bs.Checkpoint = nil
+		bs.Modified = &now
+		s[name] = bs
+	}
+}
+
+// Rename moves the state of a backup, including its verification, to a new
+// name. Fails if there's no state for the old name, or if there's some for
+// the new one. The edit happens at time now.
+func (s State) Rename(from, to string, now time.Time) error {
+	bs, ok := s.lookup(from)
+	if !ok {
+		return fmt.Errorf("no state for backup %q", from)
+	}
+	for _, k := range []string{to, VerifyStateKey(to)} {
+		if _, ok := s.lookup(k); ok {
+			return fmt.Errorf("state for %q is already present", k)
+		}
+	}
+	bs.Modified = &now
+	s[to] = bs
+	s.remove(from, now)
+	if vs, ok := s.lookup(VerifyStateKey(from)); ok {
+		vs.Modified = &now
+		s[VerifyStateKey(to)] = vs
+		s.remove(VerifyStateKey(from), now)
+	}
+	return nil
+}
+
+// Prune removes the state of the backups not in the given list, and returns
+// the removed keys, sorted. The edit happens at time now.
+//
+// Removed entries are kept as tombstones for a while, and dropped by the
+// following prunes.
+func (s State) Prune(names []string, now time.Time) []string {
+	keep := map[string]bool{}
+	for _, n := range names {
+		keep[n] = true
+		keep[VerifyStateKey(n)] = true
+	}
+	var res []string
+	for k, bs := range s {
+		if keep[k] {
+			continue
+		}
+		if bs.Deleted == nil {
+			res = append(res, k)
+			s.remove(k, now)
+		} else if now.Sub(*bs.Deleted) > tombstoneTTL {
+			delete(s, k)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// get returns the state of the given backup, empty if missing or deleted.
+func (s State) get(name string) BackupState {
+	bs, _ := s.lookup(name)
+	return bs
+}
+
+// lookup returns the state of the given backup, if present and not deleted.
+func (s State) lookup(name string) (BackupState, bool) {
+	bs, ok := s[name]
+	if !ok || bs.Deleted != nil {
+		return BackupState{}, false
+	}
+	return bs, true
+}
+
+// remove replaces the state of a backup with a tombstone.
+func (s State) remove(name string, now time.Time) {
+	s[name] = BackupState{Deleted: &now}
+}
+
+// Merge merges another state into this one. For every backup, the entry with
+// the most recent activity wins, or the other one if they are equally recent.
+//
+// Ties go to the other state, because callers merge their own changes into
+// the stored state (see backup.saveState): a change made within the same
+// clock tick as the stored one (e.g. a checkpoint cleared right after it was
+// saved) must not be lost. Checkpoints count as activity, so that the
+// progress of a run in progress wins over older stored entries.
+func (s State) Merge(other State) {
+	for name, theirs := range other {
+		ours, ok := s[name]
+		if !ok || !ours.lastActivity().After(theirs.lastActivity()) {
+			s[name] = theirs
+		}
+	}
+}
+
+func (s BackupState) lastActivity() time.Time {
+	res := s.LastSuccess
+	for _, t := range []*time.Time{s.Modified, s.Deleted} {
+		if t != nil && t.After(res) {
+			res = *t
+		}
+	}
+	if lr := s.LastRun(); lr != nil {
+		if end := lr.Start.Add(time.Duration(lr.Duration)); end.After(res) {
+			res = end
+		}
+	}
+	if cp := s.Checkpoint; cp != nil && cp.Updated.After(res) {
+		res = cp.Updated
+	}
+	return res
+}
+
 // Save saves the state to the given file
 func (s State) Save() ([]byte, error) {
 	return json.MarshalIndent(s, "", "  ")
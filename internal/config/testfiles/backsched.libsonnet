@@ -1 +0,0 @@
-../../../backsched.libsonnet
\ No newline at end of file
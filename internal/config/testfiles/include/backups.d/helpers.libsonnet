@@ -0,0 +1,2 @@
+// Not a config: ignored.
+{}
@@ -2,10 +2,15 @@ package exec
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"strings"
+	"time"
 
+	"github.com/jonboulle/clockwork"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/afero"
 )
@@ -29,6 +34,18 @@ type Cmd struct {
 	// SecretEnv contains environment variables and their value, but makes sure
 	// to not log or print their value, to avoid secrets leaking.
 	SecretEnv map[string]string
+	// SecretFiles maps environment variables to secret values. Each value is
+	// written to a temporary file readable only by the user, and the variable
+	// is set to its path. The files are removed when the command terminates.
+	// Occurrences of `${VAR}` in Args are replaced by the path too.
+	SecretFiles map[string]string
+	// SecretStdin, if not nil, is written to the command stdin.
+	SecretStdin *string
+	// Output, if not nil, receives a copy of the command stdout and stderr.
+	Output io.Writer
+	// Stdout, if not nil, receives the command stdout instead of the
+	// process stdout.
+	Stdout io.Writer
 }
 
 // Requirement is a requirement to satisfy.
@@ -58,6 +75,32 @@ type Executor struct {
 	Cfg    Config
 	Fs     afero.Fs
 	Runner Runner
+	// Start is the index of the first command to run. The previous ones are
+	// considered already completed.
+	Start int
+	// Completed, if not nil, is called after every successful command, with
+	// the number of commands completed so far.
+	Completed func(n int)
+	// Monitor, if positive, is how often the requirements are checked while
+	// the commands run. The run is aborted as soon as one of them is no
+	// longer satisfied.
+	Monitor time.Duration
+	// Clock schedules the requirement checks. Defaults to the real clock.
+	Clock clockwork.Clock
+}
+
+// RequirementError is returned when a run is aborted because a requirement
+// stopped being satisfied.
+type RequirementError struct {
+	Err error
+}
+
+func (e *RequirementError) Error() string {
+	return fmt.Sprintf("requirement no longer satisfied: %v", e.Err)
+}
+
+func (e *RequirementError) Unwrap() error {
+	return e.Err
 }
 
 // CanExecute returns true if the backup satisfies all requirements.
@@ -72,44 +115,172 @@ func (e Executor) CanExecute(ctx context.Context) error {
 
 // Run runs the backup.
 func (e Executor) Run(ctx context.Context) error {
-	for _, c := range e.Cfg.Cmds {
-		if err := e.Runner.Run(ctx, c); err != nil {
+	if e.Monitor <= 0 || len(e.Cfg.Reqs) == 0 {
+		return e.run(ctx)
+	}
+	if e.Clock == nil {
+		e.Clock = clockwork.NewRealClock()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lost := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.monitor(ctx, cancel, lost)
+	}()
+
+	err := e.run(ctx)
+	cancel()
+	<-done
+	select {
+	case rerr := <-lost:
+		// The commands may have completed in the meantime.
+		if err != nil {
+			return &RequirementError{Err: rerr}
+		}
+	default:
+	}
+	return err
+}
+
+func (e Executor) run(ctx context.Context) error {
+	for i := e.Start; i < len(e.Cfg.Cmds); i++ {
+		if err := e.Runner.Run(ctx, e.Cfg.Cmds[i]); err != nil {
 			return err
 		}
+		if e.Completed != nil {
+			e.Completed(i + 1)
+		}
 	}
 	return nil
 }
 
+// monitor checks the requirements periodically, until ctx is canceled. When
+// one is not satisfied, the error is sent to lost and the run canceled.
+func (e Executor) monitor(ctx context.Context, cancel func(), lost chan<- error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.Clock.After(e.Monitor):
+		}
+		if err := e.CanExecute(ctx); err != nil {
+			lost <- err
+			cancel()
+			return
+		}
+	}
+}
+
 // Runner is an abstraction over command execution.
 type Runner interface {
 	Run(ctx context.Context, cmd Cmd) error
 }
 
 // DefaultRunner executes the commands on the local system.
-type DefaultRunner struct{}
+//
+// When the context is canceled, the running command is asked to terminate
+// gracefully, and killed when Kill is closed or after Grace, if positive. If
+// Kill is nil, the command is killed right away.
+//
+// Grace bounds every cancellation, whatever its cause: a shutdown signal, a
+// lost requirement or a canceled daemon run.
+type DefaultRunner struct {
+	Kill  <-chan struct{}
+	Grace time.Duration
+}
 
 // Run runs a command as a subprocess.
-func (DefaultRunner) Run(ctx context.Context, cmd Cmd) error {
-	sp := exec.CommandContext(ctx, cmd.Cmd, cmd.Args...)
+func (r DefaultRunner) Run(ctx context.Context, cmd Cmd) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	files, cleanup, err := writeSecretFiles(cmd.SecretFiles)
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+	args := expandSecretFiles(cmd.Args, files)
+
+	sp := exec.Command(cmd.Cmd, args...)
 	sp.Env = append(toOSEnv(cmd.Env), toOSEnv(cmd.SecretEnv)...)
+	sp.Env = append(sp.Env, toOSEnv(files)...)
 	sp.Stdin = os.Stdin
-	sp.Stdout = os.Stdout
+	if cmd.SecretStdin != nil {
+		sp.Stdin = strings.NewReader(*cmd.SecretStdin)
+	}
+	var stdout io.Writer = os.Stdout
+	if cmd.Stdout != nil {
+		stdout = cmd.Stdout
+	}
+	sp.Stdout = stdout
 	sp.Stderr = os.Stderr
+	if cmd.Output != nil {
+		sp.Stdout = io.MultiWriter(stdout, cmd.Output)
+		sp.Stderr = io.MultiWriter(os.Stderr, cmd.Output)
+	}
 	if cmd.Workdir != "" {
 		sp.Dir = cmd.Workdir
 	}
 
 	log.Info().Msgf("Running %s %v\n", cmd.Cmd, cmd.Args)
 	if err := sp.Start(); err != nil {
-		return fmt.Errorf("starting %q: %v", cmd.Cmd, err)
+		return fmt.Errorf("starting %q: %w", cmd.Cmd, err)
 	}
+	done := make(chan struct{})
+	defer close(done)
+	go r.stopOnCancel(ctx, sp.Process, done)
 	if err := sp.Wait(); err != nil {
-		return fmt.Errorf("waiting for command %q: %v", cmd.Cmd, err)
+		return fmt.Errorf("waiting for command %q: %w", cmd.Cmd, err)
 	}
 
 	return nil
 }
 
+// stopOnCancel stops the process when the context is canceled, until done is
+// closed.
+func (r DefaultRunner) stopOnCancel(ctx context.Context, p *os.Process, done <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+	case <-done:
+		return
+	}
+	if r.Kill != nil {
+		if err := terminate(p); err == nil {
+			var timeout <-chan time.Time
+			if r.Grace > 0 {
+				t := time.NewTimer(r.Grace)
+				defer t.Stop()
+				timeout = t.C
+			}
+			select {
+			case <-r.Kill:
+				log.Warn().Msgf("Killing process %d", p.Pid)
+			case <-timeout:
+				log.Warn().Msgf("Process %d didn't terminate after %v: killing it", p.Pid, r.Grace)
+			case <-done:
+				return
+			}
+		}
+	}
+	_ = p.Kill()
+}
+
+// ExitStatus returns the exit status of the command that caused the error.
+// Returns zero if err is nil and -1 if the error was not caused by the exit
+// status of a command.
+func ExitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var eerr *exec.ExitError
+	if errors.As(err, &eerr) {
+		return eerr.ExitCode()
+	}
+	return -1
+}
+
 func toOSEnv(m map[string]string) []string {
 	var res []string
 	for k, v := range m {
@@ -117,3 +288,64 @@ func toOSEnv(m map[string]string) []string {
 	}
 	return res
 }
+
+// writeSecretFiles writes every secret to a new file, and returns a map from
+// the variables to the file paths. The cleanup function removes all the
+// files and must always be called.
+func writeSecretFiles(secrets map[string]string) (map[string]string, func(), error) {
+	res := map[string]string{}
+	cleanup := func() {
+		for _, p := range res {
+			if err := os.Remove(p); err != nil {
+				log.Warn().Err(err).Msgf("Removing secret file %q", p)
+			}
+		}
+	}
+	for name, val := range secrets {
+		p, err := writeSecretFile(val)
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("writing secret file for %s: %w", name, err)
+		}
+		res[name] = p
+	}
+	return res, cleanup, nil
+}
+
+func writeSecretFile(val string) (string, error) {
+	// Prefer the user runtime directory, which is private and in memory.
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	// CreateTemp creates the file with 0600 permissions.
+	f, err := os.CreateTemp(dir, "backsched-secret-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(val); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// expandSecretFiles replaces `${VAR}` in the arguments with the path of the
+// secret file of VAR.
+func expandSecretFiles(args []string, files map[string]string) []string {
+	if len(files) == 0 {
+		return args
+	}
+	res := make([]string, len(args))
+	for i, a := range args {
+		for name, p := range files {
+			a = strings.ReplaceAll(a, "${"+name+"}", p)
+		}
+		res[i] = a
+	}
+	return res
+}
@@ -0,0 +1,200 @@
+package exec_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mbrt/backsched/internal/exec"
+)
+
+func TestSecretDelivery(t *testing.T) {
+	stdin := "from-stdin"
+	var out bytes.Buffer
+	cmd := exec.Cmd{
+		Cmd: "/bin/sh",
+		Args: []string{"-c", `echo "$PASS"; ls -l "$PASS" | cut -c1-10; cat "$1"; echo; cat`,
+			"sh", "${PASS}"},
+		SecretFiles: map[string]string{"PASS": "from-file"},
+		SecretStdin: &stdin,
+		Stdout:      &out,
+	}
+	err := exec.DefaultRunner{}.Run(context.Background(), cmd)
+	require.Nil(t, err)
+
+	lines := strings.Split(out.String(), "\n")
+	require.Len(t, lines, 4)
+	// Only readable by the user.
+	assert.Equal(t, "-rw-------", lines[1])
+	assert.Equal(t, "from-file", lines[2])
+	assert.Equal(t, "from-stdin", lines[3])
+	// Removed afterwards.
+	_, err = os.Stat(lines[0])
+	assert.True(t, os.IsNotExist(err))
+}
+
+// readyWriter signals when the first output is written.
+type readyWriter struct {
+	buf   bytes.Buffer
+	ready chan struct{}
+}
+
+func (w *readyWriter) Write(p []byte) (int, error) {
+	if w.buf.Len() == 0 {
+		close(w.ready)
+	}
+	return w.buf.Write(p)
+}
+
+func TestTermination(t *testing.T) {
+	// run cancels the context once the script is ready. If force is true,
+	// the command is killed right after.
+	run := func(script string, kill chan struct{}, grace time.Duration, force bool) (string, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		out := &readyWriter{ready: make(chan struct{})}
+		cmd := exec.Cmd{
+			Cmd:    "/bin/sh",
+			Args:   []string{"-c", script + `; echo ready; while :; do sleep 0.01; done`},
+			Stdout: out,
+		}
+		go func() {
+			<-out.ready
+			cancel()
+			if force {
+				close(kill)
+			}
+		}()
+		err := exec.DefaultRunner{Kill: kill, Grace: grace}.Run(ctx, cmd)
+		return out.buf.String(), err
+	}
+
+	// The command is terminated gracefully.
+	out, err := run(`trap 'echo stopping; exit 3' TERM`, make(chan struct{}), 0, false)
+	assert.Equal(t, "ready\nstopping\n", out)
+	assert.Equal(t, 3, exec.ExitStatus(err))
+
+	// The command ignoring the signal is killed.
+	out, err = run(`trap '' TERM`, make(chan struct{}), 0, true)
+	assert.Equal(t, "ready\n", out)
+	assert.Equal(t, -1, exec.ExitStatus(err))
+
+	// The command ignoring the signal is killed after the grace period, even
+	// without a second signal.
+	out, err = run(`trap '' TERM`, make(chan struct{}), 100*time.Millisecond, false)
+	assert.Equal(t, "ready\n", out)
+	assert.Equal(t, -1, exec.ExitStatus(err))
+
+	// Without a kill channel, the command is killed right away.
+	out, err = run(`trap 'echo stopping; exit 3' TERM`, nil, 0, false)
+	assert.Equal(t, "ready\n", out)
+	assert.Equal(t, -1, exec.ExitStatus(err))
+
+	// Nothing is started after the context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = exec.DefaultRunner{}.Run(ctx, exec.Cmd{Cmd: "/bin/true"})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// blockingRunner runs until the context is canceled, or until release is
+// closed.
+type blockingRunner struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r blockingRunner) Run(ctx context.Context, cmd exec.Cmd) error {
+	close(r.started)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.release:
+		return nil
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	run := func(lose bool) error {
+		fs := afero.NewMemMapFs()
+		require.Nil(t, fs.MkdirAll("/mnt/disk", 0o700))
+		clock := clockwork.NewFakeClock()
+		runner := blockingRunner{make(chan struct{}), make(chan struct{})}
+		e := exec.Executor{
+			Cfg: exec.Config{
+				Reqs: []exec.Requirement{exec.DirExists{Path: "/mnt/disk"}},
+				Cmds: []exec.Cmd{{Cmd: "rsync"}},
+			},
+			Fs:      fs,
+			Runner:  runner,
+			Monitor: time.Minute,
+			Clock:   clock,
+		}
+		res := make(chan error)
+		go func() { res <- e.Run(context.Background()) }()
+		<-runner.started
+
+		// Requirements are satisfied for a while.
+		clock.BlockUntil(1)
+		clock.Advance(time.Minute)
+		clock.BlockUntil(1)
+		if !lose {
+			close(runner.release)
+			return <-res
+		}
+		require.Nil(t, fs.RemoveAll("/mnt/disk"))
+		clock.Advance(time.Minute)
+		return <-res
+	}
+
+	assert.Nil(t, run(false))
+
+	err := run(true)
+	var rerr *exec.RequirementError
+	require.True(t, errors.As(err, &rerr))
+	assert.Contains(t, err.Error(), `directory "/mnt/disk" doesn't exist`)
+	assert.Equal(t, -1, exec.ExitStatus(err))
+}
+
+func TestMonitorKill(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.Nil(t, fs.MkdirAll("/mnt/disk", 0o700))
+	clock := clockwork.NewFakeClock()
+	out := &readyWriter{ready: make(chan struct{})}
+	e := exec.Executor{
+		Cfg: exec.Config{
+			Reqs: []exec.Requirement{exec.DirExists{Path: "/mnt/disk"}},
+			Cmds: []exec.Cmd{{
+				Cmd:    "/bin/sh",
+				Args:   []string{"-c", `trap '' TERM; echo ready; while :; do sleep 0.01; done`},
+				Stdout: out,
+			}},
+		},
+		Fs: fs,
+		// The kill channel is never closed, as no signal is received.
+		Runner:  exec.DefaultRunner{Kill: make(chan struct{}), Grace: 100 * time.Millisecond},
+		Monitor: time.Minute,
+		Clock:   clock,
+	}
+	res := make(chan error)
+	go func() { res <- e.Run(context.Background()) }()
+	<-out.ready
+
+	// The command ignores the termination, and is killed after the grace
+	// period.
+	clock.BlockUntil(1)
+	require.Nil(t, fs.RemoveAll("/mnt/disk"))
+	clock.Advance(time.Minute)
+	err := <-res
+	var rerr *exec.RequirementError
+	require.True(t, errors.As(err, &rerr))
+}
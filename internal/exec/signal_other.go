@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package exec
+
+import (
+	"errors"
+	"os"
+)
+
+// Graceful termination is not supported on this platform.
+func terminate(*os.Process) error {
+	return errors.New("not supported")
+}
@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package exec
+
+import (
+	"os"
+	"syscall"
+)
+
+// terminate asks the process to terminate gracefully.
+func terminate(p *os.Process) error {
+	return p.Signal(syscall.SIGTERM)
+}
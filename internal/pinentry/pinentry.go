@@ -0,0 +1,191 @@
+// Package pinentry asks secrets through a pinentry program (e.g.
+// pinentry-gnome3, pinentry-curses), speaking the Assuan protocol.
+//
+// This allows asking secrets when there's no terminal, e.g. when running
+// under systemd.
+package pinentry
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// DefaultProgram is the pinentry program used when none is specified.
+const DefaultProgram = "pinentry"
+
+// errCanceled is the Assuan error code for a canceled operation.
+const errCanceled = "83886179"
+
+// ErrCanceled is returned when the user cancels the prompt.
+var ErrCanceled = errors.New("operation canceled by the user")
+
+// Prompt describes what to ask.
+type Prompt struct {
+	Title  string
+	Desc   string
+	Prompt string
+}
+
+// Client runs a pinentry program.
+type Client struct {
+	// Program defaults to DefaultProgram.
+	Program string
+	Args    []string
+}
+
+// GetPin asks a secret to the user.
+func (c Client) GetPin(ctx context.Context, p Prompt) (string, error) {
+	prog := c.Program
+	if prog == "" {
+		prog = DefaultProgram
+	}
+	cmd := exec.CommandContext(ctx, prog, c.Args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("starting %q: %w", prog, err)
+	}
+
+	s := session{w: stdin, r: bufio.NewReader(stdout)}
+	pin, err := s.getPin(p)
+	// Always try to terminate cleanly.
+	_ = s.send("BYE")
+	stdin.Close()
+	if werr := cmd.Wait(); werr != nil && err == nil {
+		err = fmt.Errorf("waiting for %q: %w", prog, werr)
+	}
+	return pin, err
+}
+
+// session is an Assuan session with the pinentry program.
+type session struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+func (s session) getPin(p Prompt) (string, error) {
+	// The server greets first.
+	if _, err := s.response(); err != nil {
+		return "", err
+	}
+	if tty := os.Getenv("GPG_TTY"); tty != "" {
+		// Needed by curses and tty pinentries when stdin is not a terminal.
+		// Not all of them support it, so errors are ignored.
+		if err := s.send("OPTION ttyname=" + escape(tty)); err != nil {
+			return "", err
+		}
+		if _, err := s.response(); err != nil && !isAssuanErr(err) {
+			return "", err
+		}
+	}
+	for _, c := range []struct{ cmd, arg string }{
+		{"SETTITLE", p.Title},
+		{"SETDESC", p.Desc},
+		{"SETPROMPT", p.Prompt},
+	} {
+		if c.arg == "" {
+			continue
+		}
+		if _, err := s.command(c.cmd + " " + escape(c.arg)); err != nil {
+			return "", err
+		}
+	}
+	return s.command("GETPIN")
+}
+
+// command sends a command and returns the data of the response.
+func (s session) command(cmd string) (string, error) {
+	if err := s.send(cmd); err != nil {
+		return "", err
+	}
+	return s.response()
+}
+
+func (s session) send(line string) error {
+	_, err := fmt.Fprintf(s.w, "%s\n", line)
+	return err
+}
+
+// assuanErr is an error returned by the server.
+type assuanErr struct {
+	code string
+	msg  string
+}
+
+func (e assuanErr) Error() string {
+	return fmt.Sprintf("pinentry error %s: %s", e.code, e.msg)
+}
+
+func isAssuanErr(err error) bool {
+	var ae assuanErr
+	return errors.As(err, &ae)
+}
+
+// response reads lines until the end of the response, and returns the data
+// lines, if any.
+func (s session) response() (string, error) {
+	var data strings.Builder
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("reading pinentry response: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data.String(), nil
+		case strings.HasPrefix(line, "D "):
+			data.WriteString(unescape(line[2:]))
+		case strings.HasPrefix(line, "ERR "):
+			parts := strings.SplitN(line[4:], " ", 2)
+			if parts[0] == errCanceled {
+				return "", ErrCanceled
+			}
+			ae := assuanErr{code: parts[0]}
+			if len(parts) > 1 {
+				ae.msg = parts[1]
+			}
+			return "", ae
+		case strings.HasPrefix(line, "S "), strings.HasPrefix(line, "#"), line == "":
+			// Status and comment lines are ignored.
+		default:
+			return "", fmt.Errorf("unexpected pinentry response %q", line)
+		}
+	}
+}
+
+// escape percent-encodes the characters not allowed in Assuan lines.
+func escape(s string) string {
+	r := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	return r.Replace(s)
+}
+
+// unescape decodes percent-encoded sequences in Assuan data.
+func unescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,68 @@
+package pinentry_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mbrt/backsched/internal/pinentry"
+)
+
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(key)
+	require.Nil(t, os.Setenv(key, value))
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestGetPin(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "log")
+	setenv(t, "FAKE_LOG", logPath)
+	setenv(t, "FAKE_PIN", "s3cr%25t")
+	setenv(t, "GPG_TTY", "/dev/pts/1")
+	c := pinentry.Client{Program: "testfiles/fake-pinentry.sh"}
+
+	pin, err := c.GetPin(context.Background(), pinentry.Prompt{
+		Title:  "backsched",
+		Desc:   "Secret for backup \"home\"\n100% needed",
+		Prompt: "repo:",
+	})
+	require.Nil(t, err)
+	assert.Equal(t, "s3cr%t", pin)
+
+	b, err := ioutil.ReadFile(logPath)
+	require.Nil(t, err)
+	assert.Equal(t, `OPTION ttyname=/dev/pts/1
+SETTITLE backsched
+SETDESC Secret for backup "home"%0A100%25 needed
+SETPROMPT repo:
+GETPIN
+BYE
+`, string(b))
+}
+
+func TestGetPinCanceled(t *testing.T) {
+	setenv(t, "FAKE_LOG", filepath.Join(t.TempDir(), "log"))
+	setenv(t, "FAKE_PIN", "cancel")
+	c := pinentry.Client{Program: "testfiles/fake-pinentry.sh"}
+
+	_, err := c.GetPin(context.Background(), pinentry.Prompt{Prompt: "repo:"})
+	assert.ErrorIs(t, err, pinentry.ErrCanceled)
+}
+
+func TestGetPinMissingProgram(t *testing.T) {
+	c := pinentry.Client{Program: "testfiles/does-not-exist"}
+	_, err := c.GetPin(context.Background(), pinentry.Prompt{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,30 @@
+#!/bin/sh
+# A fake pinentry speaking the Assuan protocol.
+#
+# The PIN returned is taken from FAKE_PIN. If FAKE_PIN is "cancel", the
+# operation is canceled. All the received commands are appended to FAKE_LOG.
+echo "OK Pleased to meet you"
+while read -r line; do
+    echo "$line" >> "$FAKE_LOG"
+    case "$line" in
+        GETPIN)
+            if [ "$FAKE_PIN" = "cancel" ]; then
+                echo "ERR 83886179 Operation cancelled <Pinentry>"
+            else
+                echo "S PASSWORD_FROM_CACHE"
+                echo "D $FAKE_PIN"
+                echo "OK"
+            fi
+            ;;
+        BYE)
+            echo "OK closing connection"
+            exit 0
+            ;;
+        OPTION*)
+            echo "ERR 83886254 Unknown option <Pinentry>"
+            ;;
+        *)
+            echo "OK"
+            ;;
+    esac
+done
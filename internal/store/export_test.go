@@ -0,0 +1,11 @@
+package store
+
+import (
+	"net/http"
+	"time"
+)
+
+// Sign adds the AWS Signature Version 4 headers to the request.
+func (s S3) Sign(req *http.Request, body []byte, now time.Time) {
+	s.sign(req, body, now)
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+)
+
+// File is a state store on a filesystem shared by multiple machines, e.g. a
+// NAS. Concurrent updates are serialized with a lock file.
+type File struct {
+	Fs    afero.Fs
+	Clock clockwork.Clock
+	// Path is the path to the state file.
+	Path string
+	// Owner identifies who holds the lock, e.g. the hostname.
+	Owner string
+	// StaleAfter is the age after which a lock is broken. Defaults to
+	// DefaultStaleAfter.
+	StaleAfter time.Duration
+}
+
+// Load reads the state file.
+func (f File) Load() ([]byte, error) {
+	b, err := afero.ReadFile(f.Fs, f.Path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %w", f.Path, err)
+	}
+	return b, nil
+}
+
+// Save atomically writes the state file.
+func (f File) Save(buf []byte) error {
+	return f.writeAtomic(f.Path, buf)
+}
+
+func (f File) writeAtomic(path string, buf []byte) error {
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%s.tmp", filepath.Base(path), f.Owner))
+	if err := afero.WriteFile(f.Fs, tmp, buf, 0o600); err != nil {
+		return fmt.Errorf("saving to %q: %w", tmp, err)
+	}
+	if err := f.Fs.Rename(tmp, path); err != nil {
+		return fmt.Errorf("saving to %q: %w", path, err)
+	}
+	return nil
+}
+
+// Lock acquires the lock file, waiting until it's available or the context
+// is canceled. The lock is refreshed until released, so it can be held for
+// longer than StaleAfter.
+func (f File) Lock(ctx context.Context) (func() error, error) {
+	lockp := f.Path + ".lock"
+	for {
+		info := newLockInfo(f.Owner, f.Clock.Now())
+		ok, err := f.tryLock(lockp, info)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			refresh := func(prev, next []byte) error { return f.refresh(lockp, prev, next) }
+			release := func(info []byte) error { return f.unlock(lockp, info) }
+			return hold(f.Clock, f.Owner, f.StaleAfter, info, refresh, release), nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for lock %q: %w", lockp, ctx.Err())
+		case <-f.Clock.After(lockRetry):
+		}
+	}
+}
+
+func (f File) tryLock(lockp string, info []byte) (bool, error) {
+	lf, err := f.Fs.OpenFile(lockp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err == nil {
+		defer lf.Close()
+		_, err = lf.Write(info)
+		return err == nil, err
+	}
+	if !os.IsExist(err) {
+		return false, fmt.Errorf("creating lock %q: %w", lockp, err)
+	}
+
+	// The lock is busy: break it if it's stale.
+	b, err := afero.ReadFile(f.Fs, lockp)
+	if err != nil {
+		// The lock may have been released in the meantime.
+		return false, nil
+	}
+	if isStale(b, f.Clock.Now(), f.StaleAfter) {
+		log.Warn().Msgf("Breaking stale lock %q: %s", lockp, b)
+		if err := f.Fs.Remove(lockp); err != nil && !os.IsNotExist(err) {
+			return false, fmt.Errorf("removing stale lock %q: %w", lockp, err)
+		}
+	}
+	return false, nil
+}
+
+// refresh replaces the content of the lock, unless somebody else broke and
+// acquired it in the meantime.
+func (f File) refresh(lockp string, prev, next []byte) error {
+	b, err := afero.ReadFile(f.Fs, lockp)
+	if err != nil || !bytes.Equal(b, prev) {
+		return fmt.Errorf("lock %q was broken while held", lockp)
+	}
+	// Replace the lock atomically, as partial content makes it stale.
+	return f.writeAtomic(lockp, next)
+}
+
+// unlock removes the lock, unless somebody else broke and acquired it in the
+// meantime.
+func (f File) unlock(lockp string, info []byte) error {
+	b, err := afero.ReadFile(f.Fs, lockp)
+	if err != nil || !bytes.Equal(b, info) {
+		return fmt.Errorf("lock %q was broken while held", lockp)
+	}
+	return f.Fs.Remove(lockp)
+}
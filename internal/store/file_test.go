@@ -0,0 +1,79 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mbrt/backsched/internal/store"
+)
+
+func TestFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clockwork.NewFakeClock()
+	f := store.File{Fs: fs, Clock: clock, Path: "/nas/state.json", Owner: "host1"}
+
+	_, err := f.Load()
+	assert.Error(t, err)
+	require.Nil(t, f.Save([]byte(`{"a": 1}`)))
+	b, err := f.Load()
+	require.Nil(t, err)
+	assert.Equal(t, `{"a": 1}`, string(b))
+}
+
+func TestFileLock(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clockwork.NewFakeClock()
+	f1 := store.File{Fs: fs, Clock: clock, Path: "/nas/state.json", Owner: "host1"}
+	f2 := store.File{Fs: fs, Clock: clock, Path: "/nas/state.json", Owner: "host2"}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	unlock, err := f1.Lock(context.Background())
+	require.Nil(t, err)
+
+	// The lock is busy.
+	_, err = f2.Lock(canceled)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// The lock is kept fresh while held, so it's never stale.
+	for i := 0; i < 4; i++ {
+		clock.Advance(store.DefaultStaleAfter / 3)
+		clock.BlockUntil(1)
+	}
+	_, err = f2.Lock(canceled)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Released.
+	require.Nil(t, unlock())
+	// Fire the timers left behind.
+	clock.Advance(time.Hour)
+	unlock, err = f2.Lock(context.Background())
+	require.Nil(t, err)
+	require.Nil(t, unlock())
+	clock.Advance(time.Hour)
+
+	// Stale locks, e.g. of a crashed machine, are broken.
+	require.Nil(t, afero.WriteFile(fs, "/nas/state.json.lock",
+		[]byte(`{"owner": "crashed", "created": "1970-01-01T00:00:00Z"}`), 0o600))
+	done := make(chan error)
+	go func() {
+		var err error
+		unlock, err = f1.Lock(context.Background())
+		done <- err
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	require.Nil(t, <-done)
+
+	// A lock broken by somebody else can't be released.
+	require.Nil(t, afero.WriteFile(fs, "/nas/state.json.lock", []byte(`{"owner": "other"}`), 0o600))
+	assert.Error(t, unlock())
+	_, err = fs.Stat("/nas/state.json.lock")
+	assert.NoError(t, err)
+}
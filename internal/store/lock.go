@@ -0,0 +1,78 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultStaleAfter is the age after which a lock is considered
+	// abandoned, e.g. because the machine holding it crashed.
+	DefaultStaleAfter = 30 * time.Minute
+	// lockRetry is how often a busy lock is retried.
+	lockRetry = time.Second
+)
+
+// lockInfo is the content of a lock.
+type lockInfo struct {
+	Owner   string    `json:"owner"`
+	Created time.Time `json:"created"`
+}
+
+func newLockInfo(owner string, now time.Time) []byte {
+	// Marshalling this struct can't fail.
+	b, _ := json.Marshal(lockInfo{Owner: owner, Created: now})
+	return b
+}
+
+// isStale returns true if the lock with the given content can be broken.
+// Locks that cannot be parsed are considered stale.
+func isStale(buf []byte, now time.Time, staleAfter time.Duration) bool {
+	var li lockInfo
+	if err := json.Unmarshal(buf, &li); err != nil {
+		return true
+	}
+	if staleAfter == 0 {
+		staleAfter = DefaultStaleAfter
+	}
+	return now.Sub(li.Created) > staleAfter
+}
+
+// hold keeps a lock fresh while held, so that it's never broken as stale
+// during a long backup, and returns the function releasing it.
+//
+// refresh replaces the content of the lock, failing if it doesn't match the
+// previous one anymore. release removes the lock with the given content.
+func hold(clock clockwork.Clock, owner string, staleAfter time.Duration, info []byte,
+	refresh func(prev, next []byte) error, release func(info []byte) error) func() error {
+	if staleAfter == 0 {
+		staleAfter = DefaultStaleAfter
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	cur := info
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-clock.After(staleAfter / 3):
+			}
+			next := newLockInfo(owner, clock.Now())
+			if err := refresh(cur, next); err != nil {
+				log.Error().Err(err).Msg("Refreshing lock")
+				return
+			}
+			cur = next
+		}
+	}()
+	return func() error {
+		close(stop)
+		<-done
+		return release(cur)
+	}
+}
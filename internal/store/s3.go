@@ -0,0 +1,316 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultRegion = "us-east-1"
+
+// S3 is a state store in an S3-compatible object store. Requests are signed
+// with AWS Signature Version 4 and use path-style URLs, which are supported
+// by most S3-compatible services (e.g. MinIO).
+//
+// Concurrent updates are serialized with a lock object, created with a
+// conditional write.
+type S3 struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.amazonaws.com.
+	Endpoint string
+	// Region defaults to us-east-1.
+	Region    string
+	Bucket    string
+	Key       string
+	AccessKey string
+	SecretKey string
+	// Owner identifies who holds the lock, e.g. the hostname.
+	Owner string
+	// StaleAfter is the age after which a lock is broken. Defaults to
+	// DefaultStaleAfter.
+	StaleAfter time.Duration
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+	Clock  clockwork.Clock
+}
+
+// Load downloads the state object.
+func (s S3) Load() ([]byte, error) {
+	b, status, err := s.do(context.Background(), http.MethodGet, s.Key, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %w", s.url(s.Key), err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("reading %q: %s", s.url(s.Key), statusErr(status, b))
+	}
+	return b, nil
+}
+
+// Save uploads the state object.
+func (s S3) Save(buf []byte) error {
+	b, status, err := s.do(context.Background(), http.MethodPut, s.Key, buf, nil)
+	if err != nil {
+		return fmt.Errorf("saving to %q: %w", s.url(s.Key), err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("saving to %q: %s", s.url(s.Key), statusErr(status, b))
+	}
+	return nil
+}
+
+// Lock acquires the lock object, waiting until it's available or the
+// context is canceled. The lock is refreshed until released, so it can be
+// held for longer than StaleAfter.
+func (s S3) Lock(ctx context.Context) (func() error, error) {
+	lockKey := s.Key + ".lock"
+	for {
+		info := newLockInfo(s.Owner, s.Clock.Now())
+		ok, err := s.tryLock(ctx, lockKey, info)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			refresh := func(prev, next []byte) error { return s.refresh(lockKey, prev, next) }
+			release := func(info []byte) error { return s.unlock(lockKey, info) }
+			return hold(s.Clock, s.Owner, s.StaleAfter, info, refresh, release), nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for lock %q: %w", s.url(lockKey), ctx.Err())
+		case <-s.Clock.After(lockRetry):
+		}
+	}
+}
+
+func (s S3) tryLock(ctx context.Context, lockKey string, info []byte) (bool, error) {
+	hdr := http.Header{"If-None-Match": []string{"*"}}
+	b, status, err := s.do(ctx, http.MethodPut, lockKey, info, hdr)
+	if err != nil {
+		return false, fmt.Errorf("creating lock %q: %w", s.url(lockKey), err)
+	}
+	switch status {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		// The lock is busy.
+	default:
+		return false, fmt.Errorf("creating lock %q: %s", s.url(lockKey), statusErr(status, b))
+	}
+
+	// Break the lock if it's stale.
+	b, status, err = s.do(ctx, http.MethodGet, lockKey, nil, nil)
+	if err != nil || status != http.StatusOK {
+		// The lock may have been released in the meantime.
+		return false, nil
+	}
+	if isStale(b, s.Clock.Now(), s.StaleAfter) {
+		log.Warn().Msgf("Breaking stale lock %q: %s", s.url(lockKey), b)
+		if err := s.remove(lockKey); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// refresh replaces the content of the lock, unless somebody else broke and
+// acquired it in the meantime.
+func (s S3) refresh(lockKey string, prev, next []byte) error {
+	b, status, err := s.do(context.Background(), http.MethodGet, lockKey, nil, nil)
+	if err != nil {
+		return fmt.Errorf("reading lock %q: %w", s.url(lockKey), err)
+	}
+	if status != http.StatusOK || !bytes.Equal(b, prev) {
+		return fmt.Errorf("lock %q was broken while held", s.url(lockKey))
+	}
+	b, status, err = s.do(context.Background(), http.MethodPut, lockKey, next, nil)
+	if err != nil {
+		return fmt.Errorf("refreshing lock %q: %w", s.url(lockKey), err)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("refreshing lock %q: %s", s.url(lockKey), statusErr(status, b))
+	}
+	return nil
+}
+
+// unlock removes the lock, unless somebody else broke and acquired it in the
+// meantime.
+func (s S3) unlock(lockKey string, info []byte) error {
+	b, status, err := s.do(context.Background(), http.MethodGet, lockKey, nil, nil)
+	if err != nil {
+		return fmt.Errorf("reading lock %q: %w", s.url(lockKey), err)
+	}
+	if status != http.StatusOK || !bytes.Equal(b, info) {
+		return fmt.Errorf("lock %q was broken while held", s.url(lockKey))
+	}
+	return s.remove(lockKey)
+}
+
+func (s S3) remove(key string) error {
+	b, status, err := s.do(context.Background(), http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return fmt.Errorf("removing %q: %w", s.url(key), err)
+	}
+	if status != http.StatusOK && status != http.StatusNoContent && status != http.StatusNotFound {
+		return fmt.Errorf("removing %q: %s", s.url(key), statusErr(status, b))
+	}
+	return nil
+}
+
+func (s S3) url(key string) string {
+	return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(s.Endpoint, "/"), s.Bucket, key)
+}
+
+// do performs a signed request and returns the response body and status.
+func (s S3) do(ctx context.Context, method, key string, body []byte, hdr http.Header) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	for k, vs := range hdr {
+		req.Header[k] = vs
+	}
+	s.sign(req, body, s.Clock.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	return b, resp.StatusCode, err
+}
+
+// sign adds the AWS Signature Version 4 headers to the request.
+func (s S3) sign(req *http.Request, body []byte, now time.Time) {
+	region := s.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Sign all the headers we set explicitly.
+	var names []string
+	for k := range req.Header {
+		names = append(names, strings.ToLower(k))
+	}
+	sort.Strings(names)
+	var canonHdrs strings.Builder
+	for _, n := range names {
+		fmt.Fprintf(&canonHdrs, "%s:%s\n", n, strings.TrimSpace(req.Header.Get(n)))
+	}
+	signedHdrs := strings.Join(names, ";")
+
+	canonReq := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonHdrs.String(),
+		signedHdrs,
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", day, region)
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonReq)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHdrs, sig))
+	// The Host header is sent from req.Host, not from the header map.
+	req.Header.Del("Host")
+}
+
+// canonicalPath URI-encodes every segment of the path. S3 doesn't normalize
+// paths, so they are encoded only once and kept as they are otherwise.
+func canonicalPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		segs[i] = uriEncode(s)
+	}
+	return strings.Join(segs, "/")
+}
+
+// canonicalQuery returns the query parameters sorted by name, and URI-encoded.
+func canonicalQuery(q url.Values) string {
+	var params []string
+	for k, vs := range q {
+		for _, v := range vs {
+			params = append(params, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode encodes everything but the unreserved characters, as required by
+// Signature Version 4. Note that url.QueryEscape encodes spaces as '+', and
+// url.PathEscape leaves characters like '$' unencoded.
+func uriEncode(s string) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' ||
+			b == '-' || b == '_' || b == '.' || b == '~' {
+			sb.WriteByte(b)
+			continue
+		}
+		fmt.Fprintf(&sb, "%%%02X", b)
+	}
+	return sb.String()
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func statusErr(status int, body []byte) string {
+	msg := strings.TrimSpace(string(body))
+	if len(msg) > 200 {
+		msg = msg[:200] + "..."
+	}
+	if msg == "" {
+		return http.StatusText(status)
+	}
+	return fmt.Sprintf("%s: %s", http.StatusText(status), msg)
+}